@@ -1,45 +1,303 @@
+import argparse
 import socket
+import json
+import hashlib
+import inspect
 import random
+import sys
 import time
 import logging
+import os
 from typing import Optional
 import struct
 
+from metrics import MetricsStream
+
+# Version 2 adds the versioned handshake, newline-terminated replies and the FA final-stats reply to F
+PROTOCOL_VERSION = 2
+
+# Most times the RTO is doubled across consecutive ACK timeouts (still capped at max_rto)
+MAX_RTO_BACKOFF = 6
+
+EXIT_SERVER_UNRESPONSIVE = 3
+EXIT_HANDSHAKE_REJECTED = 4
+EXIT_PROTOCOL_ERROR = 5
+EXIT_CONNECTION_LOST = 6
+EXIT_SEND_STALLED = 7
+
+class ServerUnresponsiveError(Exception):
+    """Raised when the server stops acknowledging while packets are in flight"""
+
+class ConnectionLostError(Exception):
+    """Raised when the connection drops mid-run and can't be resumed"""
+
+class SendStalledError(Exception):
+    """Raised when a send makes no progress in send_retries attempts"""
+
+class HandshakeRejectedError(Exception):
+    """Raised when the server answers the ConnectRequest with reject/<code>"""
+    def __init__(self, code, message):
+        super().__init__(f"{code}: {message}")
+        self.code = code
+
+class ServerProtocolError(Exception):
+    """Raised when the server answers a frame with ERROR:<code>:<token>:<position>"""
+    def __init__(self, code, token, position):
+        super().__init__(f"{code} (token {token!r} at position {position})")
+        self.code = code
+
+class MarkovChannel:
+    """N-state Markov loss model where every state has its own drop probability.
+
+    Defined in a JSON scenario file such as:
+        {"initial": 0,
+         "states": [{"name": "good", "loss": 0.001, "transitions": [0.99, 0.01]},
+                    {"name": "bad",  "loss": 0.3,   "transitions": [0.10, 0.90]}]}
+    where transitions[j] is the probability of moving to state j after each packet.
+    """
+    def __init__(self, states, initial=0, rng=None):
+        if not states:
+            raise ValueError("A channel needs at least one state")
+        if not 0 <= initial < len(states):
+            raise ValueError(f"Initial state {initial} is not one of the {len(states)} states")
+        for state in states:
+            if len(state['transitions']) != len(states):
+                raise ValueError(f"State {state.get('name')} needs {len(states)} transition probabilities")
+            if abs(sum(state['transitions']) - 1.0) > 1e-6:
+                raise ValueError(f"Transitions of state {state.get('name')} must sum to 1")
+            if not 0 <= state['loss'] <= 1:
+                raise ValueError(f"Loss of state {state.get('name')} must be between 0 and 1")
+        self.states = states
+        self.initial = initial
+        self.state = initial
+        self.rng = rng  # PacketClient supplies its seeded RNG when this is None
+        self.packets_in_state = [0] * len(states)
+
+    @classmethod
+    def from_file(cls, path, rng=None):
+        with open(path) as f:
+            scenario = json.load(f)
+        try:
+            return cls(scenario['states'], scenario.get('initial', 0), rng)
+        except (AttributeError, KeyError, TypeError) as e:
+            # A missing or mistyped field, reported like the other malformed scenarios
+            raise ValueError(f"malformed scenario: {e!r}") from e
+
+    def should_drop(self):
+        self.packets_in_state[self.state] += 1
+        drop = self.rng.random() <= self.states[self.state]['loss']
+        self.state = self.rng.choices(range(len(self.states)), self.states[self.state]['transitions'])[0]
+        return drop
+
+    def expected_loss(self):
+        """Long-run loss rate, weighting each state's loss by its stationary probability"""
+        n = len(self.states)
+        dist = [1.0 if i == self.initial else 0.0 for i in range(n)]
+        # Iterate the lazy chain (stay put half the time): it has the same stationary distribution,
+        # but also converges for periodic chains, where plain power iteration oscillates forever
+        for _ in range(10_000):
+            step = [sum(dist[i] * self.states[i]['transitions'][j] for i in range(n)) for j in range(n)]
+            step = [(p + q) / 2 for p, q in zip(dist, step)]
+            converged = max(abs(p - q) for p, q in zip(dist, step)) < 1e-12
+            dist = step
+            if converged:
+                break
+        return sum(p * state['loss'] for p, state in zip(dist, self.states))
+
 class PacketClient:
     def __init__(self, 
                 # host="10.0.0.150", 
                 host="localhost",  # Local testing
                 port=5001, 
                 max_packets= 10_000_000,  # Increased to 10M
-                max_seq=2**16, 
+                max_seq=2**16,  # 2**32 negotiates 32-bit sequence numbers
                 window_size=500,  # Increased for throughput
                 drop_prob=0.01,
-                transmit_delay=0.01):  # Minimized delay
+                transmit_delay=0.01,  # Minimized delay
+                retransmit_interval=5.0,  # Seconds between retransmission batches
+                send_retries=3,
+                time_scale=1.0,  # < 1 shrinks every timer proportionally
+                seed=None,  # Fixes the drop pattern for reproducible runs
+                max_ack_timeouts=3,  # Consecutive missed ACKs before the server is declared dead
+                channel=None,  # Optional MarkovChannel replacing the fixed drop_prob
+                trace_file=None,  # qlog-style JSON-SEQ event trace (.sqlog)
+                resume_session=None,  # Session ID of an aborted run to continue
+                checkpoint_file=None,  # Periodically save the run state here, for resume_checkpoint
+                resume_checkpoint=None,  # Checkpoint file of an interrupted run to continue
+                rate=None,  # Packets per second limit (token bucket), None for unpaced
+                max_retransmits=None,  # Retransmissions before a packet is abandoned, None for no limit
+                drain_timeout=30.0,  # Seconds to keep retransmitting after the last new packet
+                reconnect_attempts=3,  # Tries to resume the session after the connection drops
+                migrate_every=None,  # Move the session to a new connection after this many windows
+                metrics_port=None,  # Port for a live Server-Sent Events stream of client stats
+                quiet=False):  # Only log errors, for scripted batch runs
 
         self.host = host
         self.port = port
         self.max_packets = max_packets
+        if max_seq not in (2**16, 2**32):
+            raise ValueError("max_seq must be 2**16 or 2**32")
         self.max_seq = max_seq
+        requested_window = window_size
+        if rate:
+            if rate * retransmit_interval < 1:
+                raise ValueError("rate must allow at least one packet per retransmit_interval")
+            # Each block waits until the bucket holds all of it, so a whole window at a low rate
+            # would leave the server without data for longer than its idle timeout
+            window_size = min(window_size, int(rate * retransmit_interval))
+        self.seq_bits = 32 if max_seq == 2**32 else 16
+        self.seq_format = 'I' if self.seq_bits == 32 else 'H'
+        # Keep each R frame within the server's 1024-byte reads
+        self.max_retransmit_batch = min(window_size, 1023 // struct.calcsize(f"!{self.seq_format}"))
         self.total_sent = 0
         self.window_size = window_size
         self.drop_prob = drop_prob
+        self.rng = random.Random(seed)
+        self.channel = channel
+        if self.channel and self.channel.rng is None:
+            self.channel.rng = self.rng
         self.current_seq = 0
-        self.transmit_delay = transmit_delay
+        if time_scale <= 0:
+            raise ValueError("time_scale must be positive")
+        self.time_scale = time_scale
+        self.transmit_delay = transmit_delay * time_scale
+        # Token bucket holding up to one window of packets (at most retransmit_interval's worth);
+        # time_scale speeds it up like every timer
+        self.rate = rate / time_scale if rate else None
+        self.tokens = float(window_size)
+        self.last_refill = time.time()
+        self.send_retries = send_retries  # Attempts for transient send errors before giving up
+        self.send_timeout = 5.0 * time_scale  # A send that can't make progress this long is retried
         self.socket = None
-        self.dropped = []
+        self.recv_buffer = b''  # Received bytes after the last complete reply
+        self.dropped = []  # (seq, retransmission attempts) of every packet awaiting retransmission
         self.wrap = 0
         self.last_ack = -1
         self.last_retransmit_time = time.time()
-        self.retransmit_interval = 5.0
+        self.retransmit_interval = retransmit_interval * time_scale
+        self.drain_timeout = drain_timeout * time_scale
+        self.reconnect_attempts = reconnect_attempts
+        self.handshake_timeout = 10.0 * time_scale
+        self.reconnect_backoff = 1.0 * time_scale  # First wait before reconnecting, doubled per attempt
+        self.reconnects = 0
+        self.migrate_every = migrate_every
+        self.migrations = 0
+        self.windows_since_migration = 0
+        self.resume_point = None  # (ack, recorded, missing, digest) reported by the server when resuming
+        self.resumed_from = 0  # Packets the server recorded before this process resumed the session
+        self.inherited_missing = 0  # Losses of the earlier run, which this process can't retransmit
+        self.window_checkpoint = None  # Counters as they were before the window in flight
+        self.checkpoint_file = checkpoint_file
+        self.checkpoint_interval = 10.0 * time_scale  # Seconds between checkpoints
+        self.last_checkpoint_time = time.time()
+        self.resume_checkpoint = resume_checkpoint
+        self.checkpoint = None  # Run state loaded from resume_checkpoint
+        # The ACK timeout is the retransmission timeout (RTO), adapted from RTT samples (RFC 6298)
+        self.ack_timeout = 2.0 * time_scale
+        self.min_rto = 1.0 * time_scale
+        self.max_rto = 60.0 * time_scale
+        self.srtt = None
+        self.rttvar = None
+        self.max_ack_timeouts = max_ack_timeouts
+        self.ack_timeouts = 0
+        self.ack_wait = 0.0  # Seconds spent waiting on the current run of missed ACKs
+        self.invalid_acks = 0  # Unparsable or out-of-range ACKs, ignored
+        # After a timeout the next ACK may belong to the earlier window, so it can't be timed (Karn)
+        self.rtt_ambiguous = False
+        self.exit_code = 0
+        self.bytes_sent = 0
+        self.server_stats = None  # Final stats from the server's FA reply
+        self.run_id = None  # Server-assigned session ID
+        self.resume_session = resume_session
+        self.protocol_version = None  # Negotiated at handshake
+        # Digest of every sequence handed to the server as delivered, in send order;
+        # compared with the server's digest of what it recorded at finish
+        self.delivered_digest = hashlib.blake2b(digest_size=16)
+        self.first_sent = 0  # First transmissions only, for the expected-vs-measured check
+        self.first_dropped = 0
+        self.start_time = None  # Set once the handshake completes
+        self.end_time = None  # Set when the connection is closed
+        self.rtt_samples = []  # Seconds from sending a window to receiving its ACK
         self.retransmissions = {1: 0, 2: 0, 3: 0, 4: 0}
-        self.retransmission_counts = [0] * max_seq
+        self.max_retransmits = max_retransmits
+        self.abandoned = 0  # Packets given up on after max_retransmits attempts
+        self.metrics_port = metrics_port
+        self.metrics_server = None
+        self.metrics_interval = 2.0 * time_scale  # Seconds between streamed samples, like the server's
+        self.last_metrics_time = 0
+        self.trace = None
+        self.trace_start = time.time()
+        if trace_file:
+            self.open_trace(trace_file)
         
         # Configure logging
         logging.basicConfig(
-            level=logging.INFO,
+            level=logging.ERROR if quiet else logging.INFO,
             format='%(asctime)s - %(levelname)s - %(message)s'
         )
         self.logger = logging.getLogger(__name__)
+        if self.window_size < requested_window:
+            self.logger.info(f"Rate of {rate} packets/s sends at most {self.window_size} packets per "
+                             f"retransmit interval, reducing window size from {requested_window}")
+
+    def start_metrics_server(self):
+        """Serve periodic client stats as JSON over Server-Sent Events at /events"""
+        self.metrics_server = MetricsStream('0.0.0.0', self.metrics_port, self.metrics_sample)
+        self.logger.info(f"Streaming metrics on http://0.0.0.0:{self.metrics_port}/events")
+
+    def metrics_sample(self):
+        return {
+            'timestamp': time.time() - self.start_time if self.start_time else 0,
+            'run_id': self.run_id,
+            'total_sent': self.total_sent,
+            'last_ack': self.last_ack,
+            'awaiting_retransmission': len(self.dropped),
+            'retransmissions': sum(self.retransmissions.values()),
+            'abandoned': self.abandoned,
+            'reconnects': self.reconnects,
+            'migrations': self.migrations,
+            'smoothed_rtt': (self.srtt or 0) * 1000,
+            'rto': self.ack_timeout * 1000
+        }
+
+    def publish_metrics(self):
+        """Add a sample for stream listeners, at most once per metrics_interval"""
+        if not self.metrics_server:
+            return
+        now = time.time()
+        if now - self.last_metrics_time < self.metrics_interval:
+            return
+        self.last_metrics_time = now
+        self.metrics_server.publish(self.metrics_sample())
+
+    def stop_metrics_server(self):
+        if self.metrics_server:
+            # Listeners get a final "end" event with metrics_sample()
+            self.metrics_server.stop()
+            self.metrics_server = None
+
+    def open_trace(self, path):
+        """Start a qlog JSON-SEQ trace so runs can be inspected with qvis"""
+        self.trace = open(path, 'w')
+        self.write_trace_record({
+            'qlog_version': '0.3',
+            'qlog_format': 'JSON-SEQ',
+            'title': 'tcp_server sliding window simulation',
+            'trace': {
+                'vantage_point': {'type': 'client'},
+                'common_fields': {'time_format': 'relative', 'reference_time': self.trace_start * 1000},
+                'configuration': {'window_size': self.window_size, 'drop_prob': self.drop_prob,
+                                  'max_seq': self.max_seq}
+            }
+        })
+
+    def write_trace_record(self, record):
+        # JSON-SEQ (RFC 7464): each record starts with an ASCII record separator
+        self.trace.write('\x1e' + json.dumps(record) + '\n')
+
+    def trace_event(self, name, data):
+        if self.trace:
+            self.write_trace_record({'time': (time.time() - self.trace_start) * 1000, 'name': name, 'data': data})
 
     @staticmethod
     def get_ip_address():
@@ -62,24 +320,143 @@ class PacketClient:
             self.socket.setsockopt(socket.SOL_SOCKET, socket.SO_SNDBUF, 1048576)  # 1MB send buffer
             self.socket.setsockopt(socket.SOL_SOCKET, socket.SO_RCVBUF, 1048576)  # 1MB receive buffer
             self.socket.connect((self.host, self.port))
+            self.recv_buffer = b''
             self.logger.info(f"Connected to {self.host}:{self.port}")
 
-            self.socket.send(b'network\n')  # Send handshake message
-            data = self.socket.recv(8).decode().strip()  # Receive handshake response
-            if data == 'success':
+            request = f'network/{PROTOCOL_VERSION}'
+            if self.seq_bits != 16:
+                request += f' seq_bits={self.seq_bits}'
+            if self.resume_session:
+                request += f' session={self.resume_session}'
+            self.send_with_retry(f'{request}\n'.encode())  # Send ConnectRequest
+            # A listener that accepted but never answers mustn't hang the client
+            self.socket.settimeout(self.handshake_timeout)
+            try:
+                data = self.read_line().decode().strip()  # Receive ConnectResponse
+            except ConnectionResetError:
+                data = ''
+            finally:
+                self.socket.settimeout(None)
+            if not data:
+                # The original server only accepts a bare "network" greeting and drops the
+                # connection without a reply on a versioned one
+                raise HandshakeRejectedError('no_reply', "server closed the connection during the handshake "
+                                             "(servers older than protocol version 2 are not supported)")
+            status, _, detail = data.partition('/')
+            if status == 'success':
+                # A v2 server answers with a bare "success" only to a bare "network" greeting,
+                # which this client never sends; tolerate it as version 1 anyway
+                version, *options = detail.split() if detail else ['1']
+                self.protocol_version = int(version)
+                options = dict(option.split('=', 1) for option in options if '=' in option)
+                self.run_id = options.get('session')
+                if 'recorded' in options:
+                    self.resume_point = (int(options['ack']), int(options['recorded']),
+                                         int(options['missing']), options['digest'])
+                if int(options.get('seq_bits', 16)) != self.seq_bits:
+                    raise HandshakeRejectedError('unsupported_seq_bits',
+                                                 f"server does not support {self.seq_bits}-bit sequence numbers")
+                advertised = int(options.get('window', self.window_size))
+                if advertised < self.window_size:
+                    self.logger.info(f"Server advertises a window of {advertised}, "
+                                     f"reducing window size from {self.window_size}")
+                    self.window_size = advertised
+                    self.max_retransmit_batch = min(self.max_retransmit_batch, advertised)
+                self.logger.info(f"Negotiated protocol version {self.protocol_version}")
+                if self.run_id:
+                    self.logger.info(f"Run ID: {self.run_id}")
+                # Lets a trace be matched with the server's logs and results for the same run
+                self.trace_event('connectivity:connection_started', {
+                    'dst_ip': self.host, 'dst_port': self.port, 'protocol_version': self.protocol_version,
+                    'run_id': self.run_id, 'resumed': bool(self.resume_session)})
                 return True 
-
-            return False
+            if status == 'reject':
+                code, _, message = detail.partition(' ')
+                raise HandshakeRejectedError(code, message)
+            raise HandshakeRejectedError('bad_reply', f"unexpected ConnectResponse {data!r}")
 
         except Exception as e:
             self.logger.error(f"Connection failed: {e}")
             raise
     
+    def read_line(self, limit=256):
+        """Read one newline-terminated handshake line from the server"""
+        data = b''
+        while not data.endswith(b'\n') and len(data) < limit:
+            chunk = self.socket.recv(limit - len(data))
+            if not chunk:
+                break
+            data += chunk
+        return data
+
+    def read_reply(self):
+        """Read the server's ACK or ERROR reply to one data block"""
+        if not self.protocol_version or self.protocol_version < 2:
+            # Version 1 replies are unterminated, so each recv is taken as one reply
+            data = self.socket.recv(256)
+            if not data:
+                raise ConnectionAbortedError("server closed the connection")
+            return data.decode()
+        # Replies end with a newline; anything after it belongs to a later window
+        while b'\n' not in self.recv_buffer:
+            chunk = self.socket.recv(256)
+            if not chunk:
+                raise ConnectionAbortedError("server closed the connection")
+            self.recv_buffer += chunk
+        reply, _, self.recv_buffer = self.recv_buffer.partition(b'\n')
+        return reply.decode()
+
+    def send_with_retry(self, data):
+        """Send all of data, retrying stalled sends with backoff; fatal errors are raised"""
+        view = memoryview(data)
+        backoff = 0.05
+        attempt = 1
+        # Interrupted sends are already retried by Python (PEP 475); the one transient failure
+        # left on a blocking socket is a server that stops reading until our send buffer is full
+        previous_timeout = self.socket.gettimeout()
+        self.socket.settimeout(self.send_timeout)
+        try:
+            # socket.send() may write only part of the buffer, so resume from where it stopped
+            while view:
+                try:
+                    sent = self.socket.send(view)
+                    self.bytes_sent += sent
+                    view = view[sent:]
+                except socket.timeout:
+                    if attempt == self.send_retries:
+                        raise SendStalledError(f"send made no progress in {attempt} attempts "
+                                               f"of {self.send_timeout}s")
+                    self.logger.warning(f"Send stalled for {self.send_timeout}s, retrying in {backoff:.2f}s")
+                    time.sleep(backoff)
+                    backoff *= 2
+                    attempt += 1
+        finally:
+            self.socket.settimeout(previous_timeout)
+        return len(data)
+
+    def pace(self, packets):
+        """Wait until the token bucket holds enough tokens to send this many packets"""
+        if not self.rate:
+            return
+        now = time.time()
+        self.tokens = min(self.tokens + (now - self.last_refill) * self.rate, self.window_size)
+        self.last_refill = now
+        if self.tokens < packets:
+            time.sleep((packets - self.tokens) / self.rate)
+            self.tokens = packets
+            self.last_refill = time.time()
+        self.tokens -= packets
+
     def should_drop(self):
-        return random.random() <= self.drop_prob
+        if self.channel:
+            return self.channel.should_drop()
+        return self.rng.random() <= self.drop_prob
 
     def handle_transmit(self):
         try:
+            self.window_checkpoint = {
+                'dropped': len(self.dropped), 'first_dropped': self.first_dropped,
+                'first_sent': self.first_sent, 'total_sent': self.total_sent}
             start = self.last_ack + 1
             block = f'{start}:'
             
@@ -88,56 +465,406 @@ class PacketClient:
                 block += f'{should_drop}'
 
                 if should_drop == 0:
-                    self.dropped.append(start + i)
+                    self.dropped.append((start + i, 0))
+                    self.first_dropped += 1
+
+                if self.trace:
+                    header = {'packet_type': '1RTT', 'packet_number': (start + i) % self.max_seq}
+                    self.trace_event('transport:packet_sent', {'header': header})
+                    if should_drop == 0:
+                        self.trace_event('recovery:packet_lost', {'header': header, 'trigger': 'simulated_drop'})
 
             self.total_sent += self.window_size
-            self.socket.send(block.encode())
-            time.sleep(self.transmit_delay)
+            self.first_sent += self.window_size
+            self.pace(self.window_size)
+            send_time = time.time()
+            self.send_with_retry(block.encode())
+            delivered = [(start + i) % self.max_seq for i in range(self.window_size)
+                         if block[len(f'{start}:') + i] == '1']
+            self.delivered_digest.update(struct.pack(f"!{len(delivered)}{self.seq_format}", *delivered))
 
-            self.socket.settimeout(2.0)
+            self.socket.settimeout(self.ack_timeout)
             try:
-                data = self.socket.recv(8).decode()
-                if not data:
-                    self.logger.warning("No data received, connection may be closed")
-                    return
+                data = self.read_reply()
+                if data.startswith('ERROR:'):
+                    # Resending the same window would only repeat the violation
+                    _, code, token, position = (data.split(':', 3) + ['', ''])[:4]
+                    raise ServerProtocolError(code, token, position)
                 ack = int(data)
+                if not 0 <= ack < self.max_seq:
+                    # e.g. two unterminated version 1 ACKs read together; using it would start
+                    # the next block outside the sequence space
+                    raise ValueError(f"ACK {ack} is outside the {self.seq_bits}-bit sequence space")
+                # Only one window is in flight, so its ACK dates its send time
+                if not self.rtt_ambiguous:
+                    self.update_rto(time.time() - send_time)
+                self.rtt_ambiguous = False
                 self.wrap += 1 if self.last_ack > ack else 0
                 self.last_ack = ack
+                self.ack_timeouts = 0
+                self.ack_wait = 0.0
+                self.windows_since_migration += 1
+                self.trace_event('recovery:metrics_updated', {
+                    'last_ack': ack, 'total_sent': self.total_sent,
+                    'awaiting_retransmission': len(self.dropped),
+                    'smoothed_rtt': (self.srtt or 0) * 1000, 'rtt_variance': (self.rttvar or 0) * 1000,
+                    'rto': self.ack_timeout * 1000})
 
             except socket.timeout:
                 self.logger.warning("Socket timeout, no ACK received")
+                self.record_ack_timeout()
                 return 
             except ValueError as e:
-                self.logger.error(f"Invalid ACK format: {e}")
+                self.invalid_acks += 1
+                self.logger.error(f"Invalid ACK: {e}")
                 return 
             finally:
                 self.socket.settimeout(None)
 
+            self.publish_metrics()
+
+            # Pace after the ACK so the delay isn't counted in the RTT sample
+            time.sleep(self.transmit_delay)
+
             current_time = time.time()
             if (current_time - self.last_retransmit_time >= self.retransmit_interval) and self.dropped:
                 self.handle_retransmit()
                 self.last_retransmit_time = current_time
 
+            self.maybe_checkpoint()
             # self.logger.info(f"Last Ack: {self.last_ack} - Total sent: {self.total_sent}")
+        except SendStalledError:
+            # The window didn't go out, so it mustn't count as sent or leave its drops queued
+            self.undo_window()
+            raise
+        except (ConnectionResetError, BrokenPipeError, ConnectionAbortedError, ServerUnresponsiveError,
+                ServerProtocolError):
+            # The connection is gone, so let run() stop instead of looping on errors
+            raise
         except Exception as e:
             self.logger.error(f"Error in transmission: {e}")
 
+    def undo_window(self):
+        """Restore the counters to what they were before the window in flight was sent"""
+        checkpoint = self.window_checkpoint
+        self.dropped = self.dropped[:checkpoint['dropped']]
+        self.first_dropped = checkpoint['first_dropped']
+        self.first_sent = checkpoint['first_sent']
+        self.total_sent = checkpoint['total_sent']
+
+    def with_reconnect(self, action):
+        """Run one send step, resuming the session if the connection drops during it"""
+        try:
+            action()
+        except (ConnectionResetError, BrokenPipeError, ConnectionAbortedError) as e:
+            self.reconnect(e)
+
+    def reconnect(self, error):
+        """Resume the session on a new connection after the old one dropped"""
+        if not self.run_id or not self.reconnect_attempts:
+            raise ConnectionLostError(error)
+        self.logger.warning(f"Connection lost ({error}), resuming session {self.run_id}")
+        self.resume_connection(error, self.reconnect_attempts, self.reconnect_backoff)
+        self.reconnects += 1
+
+    def migrate(self):
+        """Deliberately move the session to a new connection (new source port), emulating NAT rebinding"""
+        old_port = self.socket.getsockname()[1]
+        self.logger.info(f"Migrating session {self.run_id} away from port {old_port}")
+        # The server takes the new connection once it has suspended the session, so there's no need
+        # to wait before the first attempt; a failed one backs off like a reconnect
+        self.resume_connection(f"migration from port {old_port}", max(self.reconnect_attempts, 1), 0)
+        self.migrations += 1
+        self.windows_since_migration = 0
+        self.logger.info(f"Session {self.run_id} migrated to port {self.socket.getsockname()[1]}")
+
+    def resume_connection(self, error, attempts, delay):
+        """Re-handshake with the session ID, backing off between attempts, and resync with the server"""
+        self.socket.close()
+        self.socket = None
+        self.resume_session = self.run_id
+        self.resume_point = None
+        for attempt in range(1, attempts + 1):
+            time.sleep(delay)
+            delay = delay * 2 if delay else self.reconnect_backoff
+            try:
+                if self.connect():
+                    break
+            except (OSError, HandshakeRejectedError) as e:
+                self.logger.warning(f"Reconnect attempt {attempt} failed: {e}")
+            if self.socket:
+                self.socket.close()
+                self.socket = None
+        else:
+            raise ConnectionLostError(f"{error}; gave up after {attempts} reconnect attempts")
+
+        if not self.resume_point:
+            self.logger.warning("Server did not report its position, continuing from our last ACK")
+            return
+        ack, recorded, _, digest = self.resume_point
+        if recorded < self.resumed_from + self.first_sent and self.window_checkpoint:
+            # The window in flight never reached the server, so undo it and send it again
+            self.undo_window()
+        else:
+            # It arrived but its ACK was lost with the connection
+            self.wrap += 1 if self.last_ack > ack else 0
+            self.last_ack = ack
+        # The server continues its digest from what it recorded, so continue ours from the same point
+        self.delivered_digest = hashlib.blake2b(bytes.fromhex(digest), digest_size=16)
+        self.window_checkpoint = None
+        self.logger.info(f"Resumed at ACK {self.last_ack} with {self.first_sent} packets sent")
+
+    def resume_from_server(self):
+        """Pick up a session started by an earlier client process where the server left it"""
+        ack, recorded, missing, digest = self.resume_point
+        self.last_ack = ack
+        self.resumed_from = recorded
+        self.total_sent = recorded
+        # The earlier process's retransmission queue is gone, so its losses stay missing
+        self.inherited_missing = missing
+        self.delivered_digest = hashlib.blake2b(bytes.fromhex(digest), digest_size=16)
+        self.logger.info(f"Resuming session {self.run_id} at ACK {ack}: {recorded} packets already sent, "
+                         f"{missing} of them missing and no longer retransmittable")
+
+    def write_checkpoint(self):
+        """Save the run state to checkpoint_file, so an interrupted run can be continued"""
+        state = {
+            'run_id': self.run_id,
+            'seq_bits': self.seq_bits,
+            'packets': self.resumed_from + self.first_sent,
+            'total_sent': self.total_sent,
+            'first_sent': self.first_sent,
+            'first_dropped': self.first_dropped,
+            'wrap': self.wrap,
+            'dropped': self.dropped,
+            'retransmissions': self.retransmissions,
+            'abandoned': self.abandoned,
+            'reconnects': self.reconnects,
+            'rng_state': self.rng.getstate(),
+            'channel_state': self.channel.state if self.channel else None
+        }
+        # Written aside and renamed, so a crash mid-write leaves the previous checkpoint intact
+        partial = f"{self.checkpoint_file}.tmp"
+        with open(partial, 'w') as f:
+            json.dump(state, f)
+        os.replace(partial, self.checkpoint_file)
+        self.last_checkpoint_time = time.time()
+
+    def maybe_checkpoint(self):
+        """Write a checkpoint if checkpoint_interval has passed since the last one"""
+        if self.checkpoint_file and time.time() - self.last_checkpoint_time >= self.checkpoint_interval:
+            self.write_checkpoint()
+
+    def read_checkpoint(self, path):
+        with open(path) as f:
+            checkpoint = json.load(f)
+        if checkpoint['seq_bits'] != self.seq_bits:
+            raise ValueError(f"{path} was written with {checkpoint['seq_bits']}-bit sequence numbers")
+        return checkpoint
+
+    def restore_checkpoint(self):
+        """Continue an interrupted run from its checkpoint, reconciled with the server's position"""
+        checkpoint = self.checkpoint
+        ack, recorded, missing, digest = self.resume_point
+        # Windows sent after the checkpoint reached the server, but which of their packets were
+        # lost is unknown, so those losses stay missing like an earlier process's in resume_from_server()
+        after_checkpoint = recorded - checkpoint['packets']
+        if after_checkpoint < 0:
+            raise ValueError(f"checkpoint is ahead of session {self.run_id} on the server")
+        self.last_ack = ack
+        self.first_sent = checkpoint['first_sent']
+        self.first_dropped = checkpoint['first_dropped']
+        self.resumed_from = recorded - self.first_sent
+        self.total_sent = checkpoint['total_sent'] + after_checkpoint
+        self.wrap = checkpoint['wrap']
+        self.dropped = [tuple(packet) for packet in checkpoint['dropped']]
+        self.retransmissions = {int(attempt): count for attempt, count in checkpoint['retransmissions'].items()}
+        self.abandoned = checkpoint['abandoned']
+        self.reconnects = checkpoint['reconnects']
+        # Packets recovered after the checkpoint are still queued and will be retransmitted again
+        self.inherited_missing = max(0, missing - len(self.dropped) - self.abandoned)
+        version, internal, gauss = checkpoint['rng_state']
+        self.rng.setstate((version, tuple(internal), gauss))
+        if self.channel and checkpoint['channel_state'] is not None:
+            self.channel.state = checkpoint['channel_state']
+        self.delivered_digest = hashlib.blake2b(bytes.fromhex(digest), digest_size=16)
+        self.logger.info(f"Resuming session {self.run_id} from checkpoint at ACK {ack}: {recorded} packets "
+                         f"already sent, {len(self.dropped)} queued for retransmission, "
+                         f"{after_checkpoint} sent after the checkpoint")
+
+    def unrecovered(self):
+        """Packets the server is still missing as far as this client knows"""
+        return len(self.dropped) + self.abandoned + self.inherited_missing
+
+    def drain(self):
+        """Keep retransmitting on the usual schedule until nothing is outstanding or the drain timeout fires"""
+        if not self.dropped or self.drain_timeout <= 0:
+            return
+        self.logger.info(f"Draining {len(self.dropped)} outstanding packets (timeout {self.drain_timeout:.1f}s)")
+        deadline = time.time() + self.drain_timeout
+        while self.dropped:
+            next_retransmit = self.last_retransmit_time + self.retransmit_interval
+            if next_retransmit > deadline:
+                break
+            time.sleep(max(0, next_retransmit - time.time()))
+            self.with_reconnect(self.handle_retransmit)
+            self.last_retransmit_time = time.time()
+            self.publish_metrics()
+            self.maybe_checkpoint()
+        if self.dropped:
+            self.logger.warning(f"Drain timed out with {len(self.dropped)} packets still unacknowledged")
+        else:
+            self.logger.info("Drain complete, all packets delivered")
+
+    def finish(self):
+        """Send F with our final counters and wait for the server's FA reply with its own"""
+        client_stats = {'sent': self.total_sent, 'unrecovered': self.unrecovered(),
+                        'abandoned': self.abandoned, 'reconnects': self.reconnects,
+                        'delivered_digest': self.delivered_digest.hexdigest()}
+        self.send_with_retry(b"F" + json.dumps(client_stats).encode())
+        if not self.protocol_version or self.protocol_version < 2:
+            # Version 1 servers don't answer F
+            return
+
+        reply, self.recv_buffer = self.recv_buffer, b''
+        self.socket.settimeout(self.ack_timeout)
+        try:
+            # The server closes the connection after FA, so read until EOF
+            while True:
+                chunk = self.socket.recv(4096)
+                if not chunk:
+                    break
+                reply += chunk
+        except socket.timeout:
+            pass
+        finally:
+            self.socket.settimeout(None)
+
+        # Skip any ACKs still queued ahead of the FA frame
+        index = reply.find(b"FA")
+        if index < 0:
+            self.logger.warning("Server did not acknowledge the finish (no final stats)")
+            return
+        try:
+            server_stats = json.loads(reply[index + 2:].decode())
+        except ValueError as e:
+            self.logger.warning(f"Invalid final stats from server: {e}")
+            return
+        self.server_stats = server_stats
+        if server_stats.get('delivered_digest') == self.delivered_digest.hexdigest():
+            self.logger.info("Server's delivered-sequence digest matches ours")
+        elif 'delivered_digest' in server_stats:
+            self.logger.warning("Server's delivered-sequence digest differs from ours: "
+                                "it recorded something other than what was sent")
+        self.logger.info(f"Reconciliation: client sent {self.total_sent} - "
+                         f"server received {server_stats['received']} - "
+                         f"missing {server_stats['missing']} - "
+                         f"client still unrecovered {self.unrecovered()}")
+
+    def report_session_summary(self):
+        """Log the client's and the server's view of the session side by side"""
+        if not self.server_stats or not self.start_time:
+            return
+        server = self.server_stats
+        unrecovered = self.unrecovered()
+        packets = self.resumed_from + self.first_sent
+        rows = [
+            ('packets', packets, server['received'] + server['missing']),
+            ('delivered', packets - unrecovered, server['received']),
+            ('missing', unrecovered, server['missing']),
+            ('retransmissions', sum(self.retransmissions.values()), server.get('retransmissions', 'n/a')),
+            ('duplicates', 'n/a', server.get('spurious_retransmissions', 'n/a')),
+            ('goodput', f"{1 - unrecovered / packets:.4f}" if packets else 'n/a',
+             f"{server['goodput']:.4f}"),
+            ('duration (s)', f"{time.time() - self.start_time:.2f}",
+             f"{server['duration']:.2f}" if 'duration' in server else 'n/a'),
+        ]
+        self.logger.info(f"Session summary {'client':>12} {'server':>12}")
+        for name, ours, theirs in rows:
+            self.logger.info(f"  {name:<16}{ours:>12} {theirs:>12}")
+
+    def report_rtt(self):
+        if not self.rtt_samples:
+            return
+        samples = sorted(self.rtt_samples)
+
+        def percentile(p):
+            return samples[min(len(samples) - 1, int(p / 100 * len(samples)))] * 1000
+
+        self.logger.info(f"RTT over {len(samples)} windows: min {samples[0] * 1000:.2f}ms - "
+                         f"mean {sum(samples) / len(samples) * 1000:.2f}ms - p50 {percentile(50):.2f}ms - "
+                         f"p95 {percentile(95):.2f}ms - p99 {percentile(99):.2f}ms - max {samples[-1] * 1000:.2f}ms")
+
+    def report_expected_goodput(self):
+        """Compare first-transmission delivery against what drop_prob predicts"""
+        if not self.first_sent:
+            return
+        measured = 1 - self.first_dropped / self.first_sent
+        if self.channel:
+            # Losses are correlated, so only the long-run rate is meaningful
+            expected = 1 - self.channel.expected_loss()
+            self.logger.info(f"Goodput (first transmission): measured {measured:.4f} - expected {expected:.4f} (Markov channel)")
+            self.logger.info(f"Packets per channel state: {self.channel.packets_in_state}")
+            return
+
+        # Each packet is dropped independently with drop_prob, so first-pass
+        # goodput is 1 - drop_prob with binomial standard error
+        expected = 1 - self.drop_prob
+        stderr = (self.drop_prob * (1 - self.drop_prob) / self.first_sent) ** 0.5
+        deviation = abs(measured - expected)
+        self.logger.info(f"Goodput (first transmission): measured {measured:.4f} - expected {expected:.4f}")
+        if deviation > max(3 * stderr, 1e-9):
+            self.logger.warning(f"Measured goodput deviates from expected by {deviation:.4f} "
+                                f"(more than 3 standard errors = {3 * stderr:.4f})")
+
+    def update_rto(self, rtt):
+        """Fold an RTT sample into SRTT/RTTVAR and recompute the ACK timeout (Jacobson/Karels)"""
+        self.rtt_samples.append(rtt)
+        if self.srtt is None:
+            self.srtt = rtt
+            self.rttvar = rtt / 2
+        else:
+            self.rttvar = 0.75 * self.rttvar + 0.25 * abs(self.srtt - rtt)
+            self.srtt = 0.875 * self.srtt + 0.125 * rtt
+        self.ack_timeout = min(max(self.srtt + 4 * self.rttvar, self.min_rto), self.max_rto)
+
+    def record_ack_timeout(self):
+        """Count a missed ACK and give up once the server has gone quiet for too long"""
+        self.ack_timeouts += 1
+        self.ack_wait += self.ack_timeout
+        self.rtt_ambiguous = True
+        if self.ack_timeouts <= MAX_RTO_BACKOFF:
+            self.ack_timeout = min(self.ack_timeout * 2, self.max_rto)
+        if self.ack_timeouts >= self.max_ack_timeouts:
+            raise ServerUnresponsiveError(
+                f"no ACK for {self.ack_timeouts} consecutive windows "
+                f"({self.ack_wait:.1f}s) with packets in flight")
+
     def handle_retransmit(self):
         if not self.dropped:
             self.logger.info("No packets to retransmit")
             return 
 
-        seqs = self.dropped[:min(self.window_size, len(self.dropped))]
+        seqs = self.dropped[:min(self.max_retransmit_batch, len(self.dropped))]
+        self.pace(len(seqs))
+        queued, sent_before, abandoned_before = list(self.dropped), self.total_sent, self.abandoned
         block = []
         keep_drop = []
-        for seq in seqs:
+        for seq, attempts in seqs:
             normalized_seq = seq % self.max_seq
-            self.retransmission_counts[normalized_seq] += 1
-            count = min(self.retransmission_counts[normalized_seq], 4)
-            self.retransmissions[count] += 1
+            # Attempts travel with the queued packet, so earlier wraps of the same number don't count
+            attempts += 1
+            self.retransmissions[min(attempts, 4)] += 1
 
+            header = {'packet_type': '1RTT', 'packet_number': normalized_seq}
+            self.trace_event('transport:packet_sent', {'header': header, 'trigger': 'retransmit_timeout'})
             if self.should_drop():
-                keep_drop.append(seq)
+                self.trace_event('recovery:packet_lost', {'header': header, 'trigger': 'simulated_drop'})
+                if self.max_retransmits and attempts >= self.max_retransmits:
+                    # Permanently lost: leaves the queue and stays missing on the server
+                    self.abandoned += 1
+                    continue
+                keep_drop.append((seq, attempts))
             else:
                 block.append(normalized_seq) 
 
@@ -147,10 +874,17 @@ class PacketClient:
 
         if block:
             try: 
-                binary_data = struct.pack(f"!{len(block)}H", *block)
-                self.socket.send(b"R" + binary_data)
+                binary_data = struct.pack(f"!{len(block)}{self.seq_format}", *block)
+                self.send_with_retry(b"R" + binary_data)
+                self.delivered_digest.update(binary_data)
                 time.sleep(self.transmit_delay)
-                self.logger.info(f"Total sent: {self.total_sent:<8} - Retransmitting {len(block)} sequences")
+                self.logger.info(f"Total sent: {self.total_sent:<8} - Retransmitting {len(block)} sequences"
+                                 f" - RTO {self.ack_timeout * 1000:.0f}ms")
+            except (ConnectionResetError, BrokenPipeError, ConnectionAbortedError, SendStalledError):
+                # The frame didn't go out, so keep its sequences queued for after a reconnect
+                # (or, if the run ends here, counted as unrecovered)
+                self.dropped, self.total_sent, self.abandoned = queued, sent_before, abandoned_before
+                raise
             except Exception as e:
                 self.logger.error(f"Error in retransmission: {e}")
                 self.logger.debug(f"Values causing error: {block}")
@@ -158,40 +892,255 @@ class PacketClient:
 
     def run(self):
         try:
-            if self.connect():
-                self.logger.info(f"Client IP address: {self.get_ip_address()}")
-                self.logger.info("Handshake established")
+            if self.metrics_port:
+                self.start_metrics_server()
+            if self.resume_checkpoint:
+                self.checkpoint = self.read_checkpoint(self.resume_checkpoint)
+                self.resume_session = self.checkpoint['run_id']
+            # connect() raises HandshakeRejectedError unless the handshake succeeded
+            self.connect()
+            self.logger.info(f"Client IP address: {self.get_ip_address()}")
+            self.logger.info("Handshake established")
+            self.start_time = time.time()
+            if self.resume_point and self.checkpoint:
+                self.restore_checkpoint()
+            elif self.resume_point:
+                self.resume_from_server()
 
-                while self.total_sent < self.max_packets:
-                    self.handle_transmit()
-                    
-            else:
-                self.logger.info("Handshake failed")
+            while self.total_sent < self.max_packets:
+                self.with_reconnect(self.handle_transmit)
+                # Only a session with an ID can be resumed on the new connection
+                if (self.migrate_every and self.run_id and self.windows_since_migration >= self.migrate_every
+                        and self.total_sent < self.max_packets):
+                    self.with_reconnect(self.migrate)
+            self.drain()
 
-            self.socket.send(b"F")
+            self.finish()
             self.logger.info("Finished")
             self.logger.info(f"Total sent: {self.total_sent} - total missing: {len(self.dropped)} - total wrap: {self.wrap}")
+            if self.max_retransmits:
+                self.logger.info(f"Abandoned after {self.max_retransmits} retransmissions: {self.abandoned}")
             self.logger.info(f"Retransmissions: {self.retransmissions}")
+            if self.reconnects:
+                self.logger.info(f"Reconnects: {self.reconnects}")
+            if self.migrations:
+                self.logger.info(f"Connection migrations: {self.migrations}")
+            if self.invalid_acks:
+                self.logger.info(f"Invalid ACKs ignored: {self.invalid_acks}")
+            self.logger.info(f"Bytes sent: {self.bytes_sent}")
+            self.report_expected_goodput()
+            self.report_rtt()
+            self.report_session_summary()
             # self.logger.info(self.dropped)
                 
         except KeyboardInterrupt:
             self.logger.info("Client stopped by user")
+        except HandshakeRejectedError as e:
+            self.logger.error(f"Server rejected the handshake: {e}")
+            self.exit_code = EXIT_HANDSHAKE_REJECTED
+        except ServerUnresponsiveError as e:
+            self.logger.error(f"Server unresponsive, aborting run: {e}")
+            self.logger.info(f"Total sent: {self.total_sent} - last ACK: {self.last_ack}")
+            self.exit_code = EXIT_SERVER_UNRESPONSIVE
+        except ConnectionLostError as e:
+            self.logger.error(f"Connection lost, aborting run: {e}")
+            self.logger.info(f"Total sent: {self.total_sent} - last ACK: {self.last_ack}")
+            self.exit_code = EXIT_CONNECTION_LOST
+        except ServerProtocolError as e:
+            self.logger.error(f"Server reported a protocol error, aborting run: {e}")
+            self.logger.info(f"Total sent: {self.total_sent} - last ACK: {self.last_ack}")
+            self.exit_code = EXIT_PROTOCOL_ERROR
+        except SendStalledError as e:
+            self.logger.error(f"Server stopped reading, aborting run: {e}")
+            self.logger.info(f"Total sent: {self.total_sent} - last ACK: {self.last_ack}")
+            self.exit_code = EXIT_SEND_STALLED
         except Exception as e:
             self.logger.error(f"Error in client operation: {e}")
+            self.exit_code = 1
         finally:
+            if self.checkpoint_file and self.run_id and self.server_stats is None:
+                # The server didn't confirm the finish, so keep the latest state for a resume
+                try:
+                    self.write_checkpoint()
+                except OSError as e:
+                    self.logger.error(f"Could not write checkpoint: {e}")
             self.close()
     
+    def result(self):
+        """Final client counters and the server's FA stats, written by --result-json"""
+        return {
+            'run_id': self.run_id,
+            'exit_code': self.exit_code,
+            'sent': self.total_sent,
+            'unrecovered': self.unrecovered(),
+            'abandoned': self.abandoned,
+            'reconnects': self.reconnects,
+            'migrations': self.migrations,
+            'retransmissions': sum(self.retransmissions.values()),
+            'invalid_acks': self.invalid_acks,
+            'bytes_sent': self.bytes_sent,
+            'duration': self.end_time - self.start_time if self.start_time and self.end_time else 0,
+            'delivered_digest': self.delivered_digest.hexdigest(),
+            'server_stats': self.server_stats
+        }
+
     def close(self):
+        self.end_time = time.time()
+        self.stop_metrics_server()
         if self.socket:
             self.socket.close()
             self.logger.info("Connection closed")
             self.socket = None
+        if self.trace:
+            self.trace.close()
+            self.trace = None
 
 
+def load_config(path):
+    """Read simulation parameters from a JSON or YAML file, keyed like the flags"""
+    with open(path) as f:
+        if path.endswith(('.yaml', '.yml')):
+            import yaml  # Optional dependency, only needed for YAML configs
+            try:
+                config = yaml.safe_load(f) or {}
+            except yaml.YAMLError as e:
+                raise ValueError(e) from e
+        else:
+            config = json.load(f)
+    if not isinstance(config, dict):
+        raise ValueError("expected a mapping of parameter names to values")
+    return {key.replace('-', '_'): value for key, value in config.items()}
+
+def parse_args(argv=None):
+    """Parse the command line, merging in a --config file; argv defaults to sys.argv[1:]"""
+    parser = argparse.ArgumentParser(description='TCP sliding window simulation client')
+    parser.add_argument('--config', metavar='PATH',
+                        help='Load parameters from a JSON or YAML file; flags given on the command line override it')
+    # Defaults come from PacketClient, so the flags and the constructor can't disagree
+    defaults = {name: param.default for name, param in inspect.signature(PacketClient).parameters.items()}
+    parser.add_argument('--host', default=defaults['host'], help='Server address')
+    parser.add_argument('--port', type=int, default=defaults['port'], help='Server port')
+    parser.add_argument('--max-packets', type=int, default=defaults['max_packets'],
+                        help='Number of packets to send before finishing')
+    parser.add_argument('--seq-bits', type=int, choices=(16, 32), default=defaults['max_seq'].bit_length() - 1,
+                        help='Width of sequence numbers, negotiated with the server')
+    parser.add_argument('--window-size', type=int, default=defaults['window_size'], help='Packets sent per window')
+    parser.add_argument('--drop-prob', type=float, default=defaults['drop_prob'],
+                        help='Probability of dropping each packet')
+    parser.add_argument('--channel', metavar='SCENARIO',
+                        help='Markov loss scenario (JSON) replacing --drop-prob')
+    parser.add_argument('--transmit-delay', type=float, default=defaults['transmit_delay'],
+                        help='Seconds to pause after each acknowledged window')
+    parser.add_argument('--retransmit-interval', type=float, default=defaults['retransmit_interval'],
+                        help='Seconds between retransmission batches')
+    parser.add_argument('--drain-timeout', type=float, default=defaults['drain_timeout'],
+                        help='Seconds to keep retransmitting lost packets after the last new one (0 to skip)')
+    parser.add_argument('--reconnect-attempts', type=int, default=defaults['reconnect_attempts'],
+                        help='Tries to resume the session if the connection drops (0 to exit instead)')
+    parser.add_argument('--migrate-every', type=int, metavar='N',
+                        help='Move the session to a new connection every N windows (needs --multi-session)')
+    parser.add_argument('--send-retries', type=int, default=defaults['send_retries'],
+                        help='Attempts for a send that fails with a transient error')
+    parser.add_argument('--max-ack-timeouts', type=int, default=defaults['max_ack_timeouts'],
+                        help='Consecutive missed ACKs before the server is declared unresponsive')
+    parser.add_argument('--time-scale', type=float, default=defaults['time_scale'],
+                        help='Multiply all timers by this factor (e.g. 0.1 for faster sweeps)')
+    parser.add_argument('--seed', type=int, help='Seed for reproducible drop decisions')
+    parser.add_argument('--trace', metavar='PATH', help='Write a qlog JSON-SEQ trace to PATH')
+    parser.add_argument('--resume-session', metavar='ID', help='Continue an aborted session on the server')
+    parser.add_argument('--checkpoint', metavar='PATH',
+                        help='Save the run state to PATH periodically and when the run is interrupted')
+    parser.add_argument('--resume', metavar='PATH',
+                        help='Continue an interrupted run from its checkpoint (and keep checkpointing to PATH)')
+    parser.add_argument('--metrics-port', type=int,
+                        help='Stream periodic client stats as Server-Sent Events on this port')
+    parser.add_argument('--rate', type=float,
+                        help='Limit sending to this many packets per second (token bucket)')
+    parser.add_argument('--max-retransmits', type=int,
+                        help='Abandon a packet after this many failed retransmissions')
+    parser.add_argument('--quiet', action='store_true', help='Suppress all log output except errors')
+    parser.add_argument('--result-json', metavar='PATH',
+                        help="Write final stats as JSON to PATH ('-' for stdout)")
+    args, _ = parser.parse_known_args(argv)
+    if args.config:
+        try:
+            config = load_config(args.config)
+        except (OSError, ValueError, ImportError) as e:
+            parser.error(f"could not load {args.config}: {e}")
+        if 'config' in config:
+            parser.error(f"{args.config} cannot load another config file")
+        unknown = set(config) - set(vars(args))
+        if unknown:
+            parser.error(f"unknown parameters in {args.config}: {', '.join(sorted(unknown))}")
+        # Defaults bypass argparse's conversion, so check the file's values like flags
+        for action in parser._actions:
+            if action.dest not in config or config[action.dest] is None:
+                continue
+            value = config[action.dest]
+            if action.nargs == 0 and not isinstance(value, bool):
+                # A flag takes no value on the command line, so only a real boolean is unambiguous;
+                # the string "false" would be truthy
+                parser.error(f"invalid {action.dest} in {args.config}: {value!r} (expected true or false)")
+            if action.type:
+                try:
+                    value = action.type(str(value))
+                except (TypeError, ValueError):
+                    parser.error(f"invalid {action.dest} in {args.config}: {config[action.dest]!r}")
+            if action.choices and value not in action.choices:
+                parser.error(f"invalid {action.dest} in {args.config}: {value!r} "
+                             f"(choose from {', '.join(map(str, action.choices))})")
+            config[action.dest] = value
+        parser.set_defaults(**config)
+    args = parser.parse_args(argv)
+    for name in ('time_scale', 'window_size', 'max_packets', 'send_retries', 'rate', 'retransmit_interval',
+                 'migrate_every', 'max_ack_timeouts', 'max_retransmits'):
+        # A zero window or retry count hangs the run, a negative rate breaks pacing, and a zero limit
+        # would give up on the server or on every packet at the first miss
+        value = getattr(args, name)
+        if value is not None and value <= 0:
+            parser.error(f"--{name.replace('_', '-')} must be positive")
+    if args.channel:
+        try:
+            args.channel = MarkovChannel.from_file(args.channel)
+        except (OSError, ValueError) as e:
+            parser.error(f"could not load {args.channel}: {e}")
+    if args.reconnect_attempts < 0:
+        parser.error("--reconnect-attempts must not be negative")
+    if args.resume and args.resume_session:
+        parser.error("--resume takes the session ID from the checkpoint, it can't be combined with --resume-session")
+    if not 0 <= args.drop_prob <= 1:
+        parser.error("--drop-prob must be between 0 and 1")
+    if args.transmit_delay < 0:
+        # time.sleep() would fail on every window, before its retransmissions are sent
+        parser.error("--transmit-delay must not be negative")
+    if args.rate and args.rate * args.retransmit_interval < 1:
+        # A block of one packet would still keep the server waiting longer than a retransmit interval
+        parser.error("--rate must allow at least one packet per --retransmit-interval")
+    return args
+
 def main():
-    client = PacketClient()
+    args = parse_args()
+    client = PacketClient(host=args.host, port=args.port, max_packets=args.max_packets,
+                          max_seq=2**args.seq_bits, window_size=args.window_size,
+                          drop_prob=args.drop_prob, transmit_delay=args.transmit_delay,
+                          retransmit_interval=args.retransmit_interval, drain_timeout=args.drain_timeout,
+                          reconnect_attempts=args.reconnect_attempts, migrate_every=args.migrate_every,
+                          send_retries=args.send_retries,
+                          time_scale=args.time_scale, seed=args.seed, max_ack_timeouts=args.max_ack_timeouts,
+                          channel=args.channel,
+                          trace_file=args.trace, resume_session=args.resume_session,
+                          checkpoint_file=args.checkpoint or args.resume, resume_checkpoint=args.resume,
+                          rate=args.rate, max_retransmits=args.max_retransmits,
+                          metrics_port=args.metrics_port, quiet=args.quiet)
     client.run()
 
+    if args.result_json == '-':
+        print(json.dumps(client.result()))
+    elif args.result_json:
+        with open(args.result_json, 'w') as f:
+            json.dump(client.result(), f, indent=2)
+    sys.exit(client.exit_code)
+
 
 if __name__ == '__main__':
     main()
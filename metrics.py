@@ -0,0 +1,82 @@
+import http.server
+import json
+import threading
+
+class MetricsStream:
+    """Serves JSON samples as Server-Sent Events at /events, shared by client and server.
+
+    Listeners get every sample published after they connect. restart() replaces
+    the samples (e.g. with a new or resumed session's), and listeners continue
+    from the start of the new list. stop() ends every stream with an "end" event
+    carrying final_stats() and shuts the HTTP server down.
+    """
+    def __init__(self, host, port, final_stats):
+        self.samples = []
+        self.generation = 0  # Bumped by restart() so listeners know their position is stale
+        self.done = False
+        self.cond = threading.Condition()  # Notified on every publish, restart and stop
+        self.final_stats = final_stats
+        stream = self
+
+        class EventsHandler(http.server.BaseHTTPRequestHandler):
+            def do_GET(self):
+                stream.handle(self)
+
+            def log_message(self, format, *args):
+                # Keep HTTP request lines out of the client/server log
+                pass
+
+        self.httpd = http.server.ThreadingHTTPServer((host, port), EventsHandler)
+        self.httpd.daemon_threads = True
+        threading.Thread(target=self.httpd.serve_forever, daemon=True).start()
+
+    def publish(self, sample):
+        with self.cond:
+            self.samples.append(sample)
+            self.cond.notify_all()
+
+    def restart(self, samples=()):
+        with self.cond:
+            self.samples = list(samples)
+            self.generation += 1
+            self.cond.notify_all()
+
+    def stop(self):
+        # The done flag is set under the condition, so a listener between its check
+        # and its wait can't miss the notification
+        with self.cond:
+            self.done = True
+            self.cond.notify_all()
+        self.httpd.shutdown()
+        self.httpd.server_close()
+
+    def handle(self, request):
+        if request.path != '/events':
+            request.send_error(404)
+            return
+        request.send_response(200)
+        request.send_header('Content-Type', 'text/event-stream')
+        request.send_header('Cache-Control', 'no-cache')
+        request.send_header('Access-Control-Allow-Origin', '*')
+        request.end_headers()
+
+        with self.cond:
+            generation, sent = self.generation, len(self.samples)
+        try:
+            while True:
+                with self.cond:
+                    self.cond.wait_for(lambda: self.done or self.generation != generation
+                                       or len(self.samples) > sent)
+                    if self.generation != generation:
+                        generation, sent = self.generation, 0
+                    samples = self.samples[sent:]
+                    done = self.done
+                for sample in samples:
+                    request.wfile.write(f"data: {json.dumps(sample)}\n\n".encode())
+                sent += len(samples)
+                if done:
+                    request.wfile.write(f"event: end\ndata: {json.dumps(self.final_stats())}\n\n".encode())
+                    break
+                request.wfile.flush()
+        except (BrokenPipeError, ConnectionResetError):
+            pass
@@ -0,0 +1,94 @@
+import argparse
+import json
+import sys
+
+def load_json(path):
+    with open(path) as f:
+        return json.load(f)
+
+def load_trace(path):
+    """Read a client qlog JSON-SEQ trace and summarize it, with the run IDs it names"""
+    run_ids = set()
+    summary = {'path': path, 'packets_sent': 0, 'packets_lost': 0, 'retransmissions': 0}
+    with open(path) as f:
+        # JSON-SEQ (RFC 7464): records start with an ASCII record separator
+        for text in f.read().split('\x1e'):
+            if not text.strip():
+                continue
+            record = json.loads(text)
+            name, data = record.get('name'), record.get('data', {})
+            if name == 'connectivity:connection_started' and data.get('run_id'):
+                run_ids.add(data['run_id'])
+            elif name == 'transport:packet_sent':
+                summary['packets_sent'] += 1
+                if data.get('trigger') == 'retransmit_timeout':
+                    summary['retransmissions'] += 1
+            elif name == 'recovery:packet_lost':
+                summary['packets_lost'] += 1
+    return run_ids, summary
+
+def merge(server, client, trace=None):
+    """Join the server's and the client's results for one run into a reconciled report.
+
+    server is the server's --result-json record, client the client's; trace is
+    an optional (run_ids, summary) pair from load_trace. Raises ValueError when
+    the artifacts don't belong to the same run.
+    """
+    run_id = server.get('session_id')
+    if not run_id:
+        raise ValueError("server result has no session_id")
+    if client.get('run_id') != run_id:
+        raise ValueError(f"client result is for run {client.get('run_id')}, server result for {run_id}")
+    if trace and run_id not in trace[0]:
+        raise ValueError(f"trace is for run(s) {', '.join(sorted(trace[0])) or 'unknown'}, not {run_id}")
+
+    # What the client believes it delivered against what the server recorded
+    reconciliation = {
+        'client_sent': client['sent'],
+        'server_received': server['received'],
+        'client_unrecovered': client['unrecovered'],
+        'server_missing': server['missing'],
+        'missing_matches': client['unrecovered'] == server['missing'],
+        'client_retransmissions': client['retransmissions'],
+        'server_retransmissions': server['retransmissions'],
+        'digest_matches': client['delivered_digest'] == server['delivered_digest'],
+        'goodput': server['goodput'],
+        'completed': client['exit_code'] == 0 and server['termination_reason'] == 'completed'
+    }
+    report = {'run_id': run_id, 'reconciliation': reconciliation, 'client': client, 'server': server}
+    if trace:
+        report['trace'] = trace[1]
+    return report
+
+def main():
+    parser = argparse.ArgumentParser(description='Work with the result files of simulation runs')
+    commands = parser.add_subparsers(dest='command', required=True)
+    merge_parser = commands.add_parser(
+        'merge', help="Join one run's server and client results into a single reconciled report")
+    merge_parser.add_argument('server', help="Server result (server.py --result-json)")
+    merge_parser.add_argument('client', help="Client result (client.py --result-json)")
+    merge_parser.add_argument('--trace', metavar='PATH', help='Client qlog trace (client.py --trace) to include')
+    merge_parser.add_argument('--output', '-o', default='-', help="Report file ('-' for stdout)")
+    args = parser.parse_args()
+
+    try:
+        server, client = load_json(args.server), load_json(args.client)
+        trace = load_trace(args.trace) if args.trace else None
+    except (OSError, ValueError) as e:
+        parser.error(f"could not load results: {e}")
+    try:
+        report = merge(server, client, trace)
+    except (ValueError, KeyError) as e:
+        sys.exit(f"Cannot merge: {e}")
+
+    if args.output == '-':
+        print(json.dumps(report, indent=2))
+    else:
+        with open(args.output, 'w') as f:
+            json.dump(report, f, indent=2)
+    # Non-zero exit lets batch scripts flag runs whose two sides disagree
+    reconciliation = report['reconciliation']
+    sys.exit(0 if reconciliation['missing_matches'] and reconciliation['digest_matches'] else 1)
+
+if __name__ == '__main__':
+    main()
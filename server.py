@@ -1,23 +1,103 @@
+import os
+import sys
+import atexit
+import signal
 import socket
 import logging
+import argparse
+import ipaddress
+import json
+import uuid
+import hashlib
 import struct
 import threading
 import time
 
+from metrics import MetricsStream
+
+# Version 2 adds the versioned handshake, newline-terminated replies and the FA final-stats reply to F
+PROTOCOL_VERSION = 2
+MIN_PROTOCOL_VERSION = 1
+
+# Largest data block accepted by default: a block has to fit in one 1024-byte read
+MAX_BATCH = 1000
+
+# Most remote addresses whose violations and bans are remembered; the least recent are forgotten first
+MAX_TRACKED_ADDRESSES = 1024
+
 class Server:
-    def __init__(self, host='0.0.0.0', port=5001, window_size=500, buffer_size=8192):
+    def __init__(self, host='0.0.0.0', port=5001, window_size=500, buffer_size=8192, strict=False,
+                 max_batch=MAX_BATCH, allow_cidrs=None, deny_cidrs=None, handshake_timeout=10.0,
+                 audit_file=None, log_file=None, time_scale=1.0, quiet=False,
+                 save_data=True, gnuplot=False, metrics_port=None, idle_timeout=30.0,
+                 dump_wire=False, multi_session=False, max_violations=None, session_ttl=300.0,
+                 max_suspended=100, ban_duration=0.0):
+        if time_scale <= 0:
+            raise ValueError("time_scale must be positive")
         self.host = host
         self.port = port
         self.window_size = window_size
         self.buffer_size = buffer_size  # Increased buffer size for better performance
+        self.strict = strict  # Reject malformed blocks with an ERROR reply instead of skipping
+        self.max_batch = max_batch  # Largest number of sequences accepted in one data block
+        self.protocol_violations = 0
+        self.max_violations = max_violations  # Disconnect a client after this many violations (None: never)
+        self.session_violations = 0
+        # Remote address -> (violations over its recent connections, time of the last one)
+        self.address_violations = {}
+        # Seconds an address that reached max_violations is refused, and that its violations are
+        # remembered for (0: never banned, max_violations applies to each connection alone)
+        self.ban_duration = ban_duration * time_scale
+        self.banned_until = {}  # Remote address -> time its ban ends
+        self.banned_connections = 0
+        self.out_of_range_seqs = 0
+        self.allow_networks = [ipaddress.ip_network(c, strict=False) for c in (allow_cidrs or [])]
+        self.deny_networks = [ipaddress.ip_network(c, strict=False) for c in (deny_cidrs or [])]
+        self.denied_connections = 0
+        self.handshake_timeout = handshake_timeout * time_scale  # Seconds to wait for the 'network' greeting
+        self.handshake_timeouts = 0
+        self.idle_timeout = idle_timeout * time_scale  # Seconds of silence after the handshake before eviction
+        self.idle_evictions = 0
+        self.bytes_sent = 0
+        self.dump_wire = dump_wire  # Log a hex/ASCII dump of every frame (rate-limited)
+        self.dump_limit = 20  # Frames dumped per second
+        self.dump_window_start = 0
+        self.dump_count = 0
+        self.dump_suppressed = 0
+        self.connection_errors = 0  # Unexpected exceptions that ended a connection
+        self.audit_file = audit_file  # JSON-lines file with one record per connection
+        self.log_file = log_file
+        self.quiet = quiet  # Only log errors, for scripted batch runs
+        self.termination_reason = None
+        self.client_version = None  # Protocol version negotiated with the current client
+        self.client_options = {}
+        self.multi_session = multi_session  # Keep accepting sessions instead of exiting after one
+        self.session_id = None
+        self.suspended_sessions = {}  # session ID -> (suspend time, tracker state) of aborted sessions
+        self.session_ttl = session_ttl * time_scale  # Seconds a suspended session can still be resumed
+        self.max_suspended = max_suspended  # Oldest suspended sessions are dropped beyond this many
+        self.save_data = save_data  # Write sequence_data_*.csv when a connection closes
+        self.gnuplot = gnuplot  # Also write a gnuplot script that charts the CSV
         self.server = None
+        self.stop_event = None  # Set by serve(); ends the accept loop and any session in progress
         self.total_recv = 0 
+        self.retransmitted_recv = 0  # Part of total_recv that arrived in R frames
+        self.block_seqs = 0  # Sequences covered by data blocks, received or missing
+        self.spurious_retransmissions = 0  # Retransmitted sequences that were never missing
         self.missing_seqs = []
+        self.missing_since = {}  # seq -> time it was first reported missing
+        self.recovery_latencies = []  # Seconds each recovered packet waited behind its loss
+        self.delivered_digest = hashlib.blake2b(digest_size=16)  # Rolling digest of recorded sequences
         self.max_seq = 2**16
+        self.seq_format = 'H'  # struct format of a retransmitted sequence; 'I' in 32-bit mode
         self.last_ack = 0
         self.start_time = time.time()
         self.seqs_over_time = []
-        self.stop_goodput_timer = False
+        self.report_interval = 2 * time_scale  # Seconds between goodput samples
+        self.metrics_port = metrics_port  # Port for the live Server-Sent Events stream
+        self.metrics_server = None
+        self.stats_lock = threading.Lock()  # Guards total_recv/missing_seqs against the reporter thread
+        self.stop_goodput_timer = threading.Event()
         self.goodput_thread = threading.Thread(target=self.goodput_timer, daemon=True)
         self.goodput_thread.start()
         self.setup_logging()
@@ -35,22 +115,110 @@ class Server:
             s.close()
         return ip
 
+    def is_address_allowed(self, ip):
+        """Check a remote address against the deny and allow lists (deny wins)"""
+        addr = ipaddress.ip_address(ip)
+        if any(addr in net for net in self.deny_networks):
+            return False
+        if self.allow_networks:
+            return any(addr in net for net in self.allow_networks)
+        return True
+
+    def is_banned(self, ip):
+        """Check whether a remote address is banned for protocol violations"""
+        return self.banned_until.get(ip, 0) > time.time()
+
+    def earlier_violations(self, ip):
+        """Violations of an address's earlier connections that still count toward max_violations"""
+        if self.ban_duration <= 0:
+            return 0
+        return self.address_violations.get(ip, (0, 0))[0]
+
+    def record_address_violations(self, ip):
+        """Add a connection's violations to its address, banning the address once it reaches max_violations"""
+        if not self.session_violations:
+            return
+        count = self.earlier_violations(ip) + self.session_violations
+        if self.max_violations and self.ban_duration > 0 and count >= self.max_violations:
+            self.banned_until[ip] = time.time() + self.ban_duration
+            # The count expires together with the ban, so the address starts over when it ends
+            self.logger.warning(f"Banning {ip} for {self.ban_duration}s after {count} protocol violations")
+        # Re-inserted, so the dict stays ordered from least to most recent
+        self.address_violations.pop(ip, None)
+        self.address_violations[ip] = (count, time.time())
+
+    def expire_address_records(self):
+        """Forget ended bans, violations older than ban_duration, and the least recent addresses
+        beyond MAX_TRACKED_ADDRESSES, so clients from many addresses can't grow them without bound"""
+        now = time.time()
+        self.banned_until = {ip: until for ip, until in self.banned_until.items() if until > now}
+        if self.ban_duration > 0:
+            self.address_violations = {ip: (count, last) for ip, (count, last) in self.address_violations.items()
+                                       if now - last < self.ban_duration}
+        for records in (self.banned_until, self.address_violations):
+            while len(records) > MAX_TRACKED_ADDRESSES:
+                del records[next(iter(records))]
+
     def goodput_timer(self):
-        while not self.stop_goodput_timer:
-            time.sleep(2)
+        # wait() instead of sleep() so stop_timers() ends the thread immediately
+        while not self.stop_goodput_timer.wait(self.report_interval):
             self.record_data()
             self.print_goodput()
     
+    def stop_timers(self):
+        """Stop the goodput reporter thread and wait for it to exit"""
+        self.stop_goodput_timer.set()
+        if self.goodput_thread.is_alive() and self.goodput_thread is not threading.current_thread():
+            self.goodput_thread.join()
+
+    def start_metrics_server(self):
+        """Serve each goodput sample as JSON over Server-Sent Events at /events"""
+        with self.stats_lock:
+            self.metrics_server = MetricsStream(self.host, self.metrics_port, self.stats)
+            self.restart_metrics_stream()
+        self.logger.info(f"Streaming metrics on http://{self.host}:{self.metrics_port}/events")
+
+    def restart_metrics_stream(self):
+        """Point stream listeners at the current session's samples; call with stats_lock held"""
+        if self.metrics_server:
+            # Labelled like the client's samples so both streams can be joined
+            self.metrics_server.restart({**sample, 'run_id': self.session_id} for sample in self.seqs_over_time)
+
+    def stop_metrics_server(self):
+        if self.metrics_server:
+            self.metrics_server.stop()
+            self.metrics_server = None
+
     def setup_logging(self):
         """Set up consistent logging configuration"""
         logging.basicConfig(
-            level=logging.INFO,
-            format='%(asctime)s - %(levelname)s - %(message)s'
+            level=logging.ERROR if self.quiet else logging.INFO,
+            format='%(asctime)s - %(levelname)s - %(message)s',
+            filename=self.log_file
         )
         self.logger = logging.getLogger(__name__)
     
+    @staticmethod
+    def get_inherited_listener():
+        """Return the listening socket passed in by systemd socket activation, if any"""
+        SD_LISTEN_FDS_START = 3
+        if os.environ.get('LISTEN_PID') != str(os.getpid()):
+            return None
+        if int(os.environ.get('LISTEN_FDS', '0')) < 1:
+            return None
+        # Unset so child processes don't mistake the descriptors for their own
+        for name in ('LISTEN_PID', 'LISTEN_FDS', 'LISTEN_FDNAMES'):
+            os.environ.pop(name, None)
+        return socket.socket(fileno=SD_LISTEN_FDS_START)
+
     def setup(self):
         """Set up and initialize the socket server"""
+        inherited = self.get_inherited_listener()
+        if inherited:
+            self.server = inherited
+            self.logger.info(f"Using socket-activated listener on {self.server.getsockname()}")
+            return
+
         try:
             self.server = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
             self.server.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
@@ -63,23 +231,92 @@ class Server:
             self.logger.error(f"Socket setup error: {e}")
             raise
 
+    def snapshot_counters(self):
+        """Read total received and missing count as one consistent pair"""
+        with self.stats_lock:
+            return self.total_recv, len(self.missing_seqs)
+
     def record_data(self):
-        current_time = time.time() - self.start_time
-        goodput = (self.total_recv) / (self.total_recv + len(self.missing_seqs)) if self.total_recv > 0 else 0
-        self.seqs_over_time.append({
-            'timestamp': current_time,
-            'window_size': self.window_size,
-            'received': self.total_recv - len(self.missing_seqs),
-            'sent': self.total_recv,
-            'missing': len(self.missing_seqs),
-            'goodput': goodput
-        })
+        # Under the lock, so a session starting in between can't mix its clock and samples with ours
+        with self.stats_lock:
+            current_time = time.time() - self.start_time
+            total_recv, missing = self.total_recv, len(self.missing_seqs)
+            goodput = (total_recv) / (total_recv + missing) if total_recv > 0 else 0
+            sample = {
+                'timestamp': current_time,
+                'window_size': self.window_size,
+                'received': total_recv - missing,
+                'sent': total_recv,
+                'missing': missing,
+                'goodput': goodput,
+                # Streamed with every sample so misbehaving clients show up while the server runs
+                'protocol_violations': self.protocol_violations,
+                'session_violations': self.session_violations,
+                'banned_connections': self.banned_connections,
+                'banned_addresses': self.banned_addresses()
+            }
+            self.seqs_over_time.append(sample)
+            if self.metrics_server:
+                self.metrics_server.publish({**sample, 'run_id': self.session_id})
 
     def print_goodput(self):
-        if self.total_recv == 0:
+        total_recv, missing = self.snapshot_counters()
+        if total_recv == 0:
             return
-        goodput = (self.total_recv) / (self.total_recv + len(self.missing_seqs))
-        self.logger.info(f"Recv: {self.total_recv} - Missing: {len(self.missing_seqs)} - Goodput: {goodput:.4f}")
+        goodput = (total_recv) / (total_recv + missing)
+        self.logger.info(f"Recv: {total_recv} - Missing: {missing} - Goodput: {goodput:.4f}")
+
+    @staticmethod
+    def hexdump(data, width=16):
+        """Format bytes as offset, hex and ASCII columns"""
+        lines = []
+        for offset in range(0, len(data), width):
+            chunk = data[offset:offset + width]
+            hex_part = ' '.join(f"{b:02x}" for b in chunk)
+            ascii_part = ''.join(chr(b) if 32 <= b < 127 else '.' for b in chunk)
+            lines.append(f"  {offset:04x}  {hex_part:<{width * 3}} {ascii_part}")
+        return '\n'.join(lines)
+
+    def dump_frame(self, direction, data):
+        """Log a frame for --dump-wire, dropping dumps beyond dump_limit per second"""
+        if not self.dump_wire:
+            return
+        now = time.time()
+        if now - self.dump_window_start >= 1:
+            if self.dump_suppressed:
+                self.logger.info(f"[wire] {self.dump_suppressed} frames not dumped (rate limit)")
+            self.dump_window_start = now
+            self.dump_count = 0
+            self.dump_suppressed = 0
+        if self.dump_count >= self.dump_limit:
+            self.dump_suppressed += 1
+            return
+        self.dump_count += 1
+        self.logger.info(f"[wire] {direction} {len(data)} bytes\n{self.hexdump(data)}")
+
+    def send_all(self, conn, payload):
+        """Write the whole payload to the client, counting the bytes sent"""
+        self.dump_frame('send', payload)
+        conn.sendall(payload)
+        self.bytes_sent += len(payload)
+
+    def send_reply(self, conn, reply):
+        """Answer a data frame with an ACK or ERROR reply"""
+        # Version 2 ends every reply with a newline, so replies that arrive together can be told apart
+        if self.client_version and self.client_version >= 2:
+            reply += '\n'
+        self.send_all(conn, reply.encode())
+
+    def record_violation(self):
+        """Count a malformed frame, strict or not, toward the --max-violations limit"""
+        self.protocol_violations += 1
+        self.session_violations += 1
+
+    def send_error(self, conn, code, token, position):
+        """Report a protocol violation to the client as ERROR:<code>:<token>:<position>"""
+        self.record_violation()
+        self.logger.warning(f"Protocol violation {code} at position {position}: {token!r}")
+        self.send_reply(conn, f"ERROR:{code}:{token}:{position}")
 
     def process_client_data(self, data, conn):
         """Process received data and update tracking information"""
@@ -87,39 +324,86 @@ class Server:
             # Add validation for data format
             decoded_data = data.decode()
             if ":" not in decoded_data:
+                if self.strict:
+                    self.send_error(conn, "MALFORMED", decoded_data[:16], 0)
+                    return
+                self.record_violation()
                 self.logger.error(f"Malformed data received: {decoded_data}")
-                conn.send(f"{self.last_ack}".encode())
+                self.send_reply(conn, f"{self.last_ack}")
                 return
                 
             data = decoded_data.split(":")
             if len(data) < 2:
                 self.logger.error(f"Split data has insufficient parts: {data}")
-                conn.send(f"{self.last_ack}".encode())
+                self.send_reply(conn, f"{self.last_ack}")
                 return
                 
-            start = int(data[0])
+            try:
+                start = int(data[0])
+            except ValueError:
+                if self.strict:
+                    self.send_error(conn, "BAD_START", data[0][:16], 0)
+                    return
+                self.record_violation()
+                self.logger.error(f"Invalid block start: {data[0][:16]!r}")
+                self.send_reply(conn, f"{self.last_ack}")
+                return
             binary = data[1]
+
+            # The client starts each block at last_ack + 1, so max_seq itself is valid
+            if not 0 <= start <= self.max_seq:
+                self.out_of_range_seqs += 1
+                if self.strict:
+                    self.send_error(conn, "SEQ_OUT_OF_RANGE", start, 0)
+                    return
+                self.record_violation()
+                self.logger.error(f"Block start {start} is outside the sequence space")
+                self.send_reply(conn, f"{self.last_ack}")
+                return
+
+            if len(binary) > self.max_batch:
+                self.send_error(conn, "BATCH_TOO_LARGE", len(binary), self.max_batch)
+                return
+
+            if self.strict:
+                # Validate the whole block before applying any of it
+                offset = len(data[0]) + 1
+                for i, b in enumerate(binary):
+                    if b not in '01':
+                        self.send_error(conn, "BAD_TOKEN", b, offset + i)
+                        return
+
             self.window_size = len(binary)
             count = 0
 
-            for b in binary:
-                seq = (start + count) % self.max_seq
+            delivered = []
+            unexpected = False
+            with self.stats_lock:
+                for b in binary:
+                    seq = (start + count) % self.max_seq
 
-                if b == '1':
-                    self.last_ack = seq       
-                    self.total_recv += 1
-                elif b == '0':
-                    self.missing_seqs.append(seq)
-                else:
-                    self.logger.warning(f"Unexpected character in binary string: {b}")
-                count += 1
+                    if b == '1':
+                        self.last_ack = seq       
+                        self.total_recv += 1
+                        delivered.append(seq)
+                    elif b == '0':
+                        self.missing_seqs.append(seq)
+                        self.missing_since[seq] = time.time()
+                    else:
+                        self.logger.warning(f"Unexpected character in binary string: {b}")
+                        unexpected = True
+                    count += 1
+                self.block_seqs += count
+                self.delivered_digest.update(struct.pack(f"!{len(delivered)}{self.seq_format}", *delivered))
+            if unexpected:
+                self.record_violation()
 
-            conn.send(f"{self.last_ack}".encode())
+            self.send_reply(conn, f"{self.last_ack}")
 
         except Exception as e:
             self.logger.error(f"Error processing client data: {e}")
             # Send last known ack to keep connection alive
-            conn.send(f"{self.last_ack}".encode())
+            self.send_reply(conn, f"{self.last_ack}")
 
     def process_client_retransmission(self, data, conn):
         try:
@@ -128,15 +412,32 @@ class Server:
                 self.logger.warning("Received empty retransmission data")
                 return
                 
-            n = len(binary_data) // 2 
+            seq_size = struct.calcsize(f"!{self.seq_format}")
+            if self.strict and len(binary_data) % seq_size:
+                self.send_error(conn, "BAD_LENGTH", len(binary_data), len(binary_data) // seq_size * seq_size)
+                return
+            if len(binary_data) % seq_size:
+                self.record_violation()
+                self.logger.warning(f"Ignoring {len(binary_data) % seq_size} trailing bytes in retransmission frame")
+            n = len(binary_data) // seq_size
             if n > 0:
                 try:
-                    actual_data = binary_data[:n*2]
-                    seqs = struct.unpack(f"!{n}H", actual_data)
-                    self.total_recv += len(seqs)
-                    for seq in seqs:
-                        if seq in self.missing_seqs:
-                            self.missing_seqs.remove(seq)
+                    actual_data = binary_data[:n*seq_size]
+                    # Packed with the negotiated width, so every value is within the sequence space
+                    seqs = struct.unpack(f"!{n}{self.seq_format}", actual_data)
+                    with self.stats_lock:
+                        self.total_recv += len(seqs)
+                        self.delivered_digest.update(struct.pack(f"!{len(seqs)}{self.seq_format}", *seqs))
+                        self.retransmitted_recv += len(seqs)
+                        now = time.time()
+                        for seq in seqs:
+                            if seq in self.missing_seqs:
+                                self.missing_seqs.remove(seq)
+                                since = self.missing_since.pop(seq, None)
+                                if since is not None:
+                                    self.recovery_latencies.append(now - since)
+                            else:
+                                self.spurious_retransmissions += 1
                 except struct.error as e:
                     self.logger.error(f"Unpacking error: {e}")
                     self.logger.debug(f"Raw data: {binary_data.hex()}")
@@ -145,13 +446,133 @@ class Server:
         except Exception as e:
             self.logger.error(f"Error processing retransmission: {e}")
 
+    def finish_session(self, data, conn):
+        """Answer the client's F frame with FA + final stats and log a reconciliation"""
+        client_stats = {}
+        if len(data) > 1:
+            try:
+                client_stats = json.loads(data[1:].decode())
+            except (ValueError, UnicodeDecodeError):
+                self.logger.warning(f"Could not parse client final stats: {data[1:80]!r}")
+
+        server_stats = self.stats()
+        # Version 1 clients send a bare F and close without waiting for a reply
+        if self.client_version and self.client_version >= 2:
+            try:
+                self.send_all(conn, b"FA" + json.dumps(server_stats).encode())
+            except OSError as e:
+                self.logger.warning(f"Could not send final stats: {e}")
+
+        if 'delivered_digest' in client_stats:
+            if client_stats['delivered_digest'] == server_stats['delivered_digest']:
+                self.logger.info("Delivered-sequence digest matches the client")
+            else:
+                self.logger.warning("Delivered-sequence digest differs from the client: "
+                                    "what was recorded is not what the client sent")
+        if 'sent' in client_stats:
+            self.logger.info(f"Reconciliation: client sent {client_stats['sent']} - "
+                             f"server received {server_stats['received']} - "
+                             f"missing {server_stats['missing']} - "
+                             f"client still unrecovered {client_stats.get('unrecovered', 'n/a')}")
+
+    @staticmethod
+    def read_handshake_line(conn, timeout, limit=256):
+        """Read the client's newline-terminated ConnectRequest within timeout seconds overall"""
+        # One deadline for the whole line, so a client dripping bytes can't extend it
+        deadline = time.time() + timeout
+        data = b''
+        while not data.endswith(b'\n') and len(data) < limit:
+            remaining = deadline - time.time()
+            if remaining <= 0:
+                raise socket.timeout("handshake deadline exceeded")
+            conn.settimeout(remaining)
+            chunk = conn.recv(limit - len(data))
+            if not chunk:
+                break
+            data += chunk
+        return data
+
+    def reject_handshake(self, conn, code, message):
+        """Send a typed ConnectResponse rejection: reject/<code> <message>"""
+        self.logger.warning(f"Rejecting handshake: {code} ({message})")
+        self.send_all(conn, f"reject/{code} {message}\n".encode())
+
     def handshake(self, data, conn):
-        """Perform handshake with the client"""
-        data = data.decode().strip()  # Fixed decoding
-        if data == 'network':
-            conn.send(b'success\n')
-            return True 
-        return False
+        """Perform handshake with the client, negotiating the protocol version.
+
+        ConnectRequest is "network" (version 1) or "network/<version> [key=value ...]".
+        ConnectResponse is "success" for version 1 clients, "success/<version>" for
+        newer ones, or "reject/<code> <message>".
+        """
+        try:
+            tokens = data.decode().split()
+        except UnicodeDecodeError:
+            tokens = []
+        greeting, _, version = (tokens[0] if tokens else '').partition('/')
+        if greeting != 'network':
+            self.reject_handshake(conn, 'bad_greeting', 'expected network[/<version>]')
+            return False
+
+        try:
+            requested = int(version) if version else 1
+        except ValueError:
+            self.reject_handshake(conn, 'bad_version', f"invalid version {version!r}")
+            return False
+        negotiated = min(requested, PROTOCOL_VERSION)
+        if negotiated < MIN_PROTOCOL_VERSION:
+            self.reject_handshake(conn, 'unsupported_version',
+                                  f"supported={MIN_PROTOCOL_VERSION}-{PROTOCOL_VERSION}")
+            return False
+
+        self.client_version = negotiated
+        self.client_options = dict(token.split('=', 1) for token in tokens[1:] if '=' in token)
+
+        # seq_bits=32 widens the sequence space so it doesn't wrap every 65,536 packets
+        if self.client_options.get('seq_bits', '16') not in ('16', '32'):
+            self.reject_handshake(conn, 'bad_option', f"unsupported seq_bits={self.client_options['seq_bits']}")
+            return False
+        seq_bits = int(self.client_options.get('seq_bits', '16'))
+        self.max_seq = 2**seq_bits
+        self.seq_format = 'I' if seq_bits == 32 else 'H'
+
+        resume_id = self.client_options.get('session')
+        if resume_id:
+            self.expire_suspended_sessions()
+            if resume_id not in self.suspended_sessions:
+                self.reject_handshake(conn, 'unknown_session', f"no suspended session {resume_id}")
+                return False
+            self.restore_session(self.suspended_sessions.pop(resume_id)[1])
+            self.session_id = resume_id
+            with self.stats_lock:
+                # Stream the resumed session's timeseries from its start
+                self.restart_metrics_stream()
+            self.logger.info(f"Resuming session {resume_id} at {self.total_recv} packets received")
+        else:
+            self.session_id = uuid.uuid4().hex[:12]
+            with self.stats_lock:
+                # Session duration and the timeseries count from the handshake, not from
+                # samples taken while waiting for a client
+                self.start_time = time.time()
+                self.seqs_over_time = []
+                self.restart_metrics_stream()
+
+        if negotiated == 1:
+            self.send_all(conn, b'success\n')
+        else:
+            # window= advertises the largest block this server accepts (flow control)
+            response = f"success/{negotiated} session={self.session_id} seq_bits={seq_bits} window={self.max_batch}"
+            if resume_id:
+                # Lets the client tell whether its last window arrived before the connection dropped,
+                # and continue the delivered-sequence digest from what was recorded so far
+                with self.stats_lock:
+                    recorded_digest = self.delivered_digest.hexdigest()
+                    self.delivered_digest = hashlib.blake2b(bytes.fromhex(recorded_digest), digest_size=16)
+                    missing = len(self.missing_seqs)
+                response += (f" ack={self.last_ack} recorded={self.block_seqs} missing={missing}"
+                             f" digest={recorded_digest}")
+            self.send_all(conn, f"{response}\n".encode())
+        self.logger.info(f"Negotiated protocol version {negotiated} (client requested {requested})")
+        return True
 
     def save_seq_data_to_file(self):
         """Save the sequence data to a CSV file"""
@@ -160,69 +581,372 @@ class Server:
             from datetime import datetime
             
             timestamp = datetime.now().strftime("%Y%m%d_%H%M%S")
-            filename = f"sequence_data_{timestamp}.csv"
+            # Several sessions can end within the same second in multi-session mode
+            suffix = f"_{self.session_id}" if self.multi_session and self.session_id else ''
+            filename = f"sequence_data_{timestamp}{suffix}.csv"
             
             self.logger.info(f"Saving sequence data to {filename}")
             
             with open(filename, 'w', newline='') as csvfile:
                 fieldnames = ['timestamp', 'window_size', 'received', 'sent', 'missing', 'goodput']
-                writer = csv.DictWriter(csvfile, fieldnames=fieldnames)
+                # Violation counters are only streamed, the CSV keeps its plotting columns
+                writer = csv.DictWriter(csvfile, fieldnames=fieldnames, extrasaction='ignore')
                 
                 writer.writeheader()
                 for data_point in self.seqs_over_time:
                     writer.writerow(data_point)
                     
             self.logger.info(f"Successfully saved {len(self.seqs_over_time)} data points")
+            if self.gnuplot:
+                self.write_gnuplot_script(filename)
         except Exception as e:
             self.logger.error(f"Error saving sequence data: {e}")
 
+    def write_gnuplot_script(self, csv_filename):
+        """Write a gnuplot script next to the CSV that charts every column over time"""
+        base = csv_filename[:-len('.csv')]
+        script = f"""# Usage: gnuplot {base}.gp
+set datafile separator ','
+set key autotitle columnhead
+set terminal pngcairo size 1600,1000
+set output '{base}.png'
+set xlabel 'Time (seconds)'
+set grid
+set multiplot layout 2,2 title '{csv_filename}'
+plot '{csv_filename}' using 1:3 with lines lw 2
+plot '{csv_filename}' using 1:5 with lines lw 2 lc rgb '#d62728'
+set yrange [0:1]
+plot '{csv_filename}' using 1:6 with lines lw 2 lc rgb '#2ca02c'
+set autoscale y
+plot '{csv_filename}' using 1:2 with lines lw 2 lc rgb '#9467bd'
+unset multiplot
+"""
+        with open(f"{base}.gp", 'w') as f:
+            f.write(script)
+        self.logger.info(f"Saved gnuplot script to {base}.gp")
+
+    def write_audit_record(self, record):
+        """Append one connection record to the audit log, if enabled"""
+        if not self.audit_file:
+            return
+        try:
+            with open(self.audit_file, 'a') as f:
+                f.write(json.dumps(record) + '\n')
+        except OSError as e:
+            self.logger.error(f"Error writing audit record: {e}")
+
     def handle_client(self, conn, addr):
-        """Handle a client connection"""
+        """Handle a client connection, returning True if the handshake succeeded"""
         self.logger.info(f"Connected by {addr}")
+        handshaken = False
+        self.session_id = None
+        # Nothing negotiated with an earlier client may show up in this connection's record
+        self.client_version = None
+        self.client_options = {}
+        greeting = None
+        started = time.time()
+        recv_before = self.total_recv
+        sent_before = self.bytes_sent
+        bytes_received = 0
+        self.session_violations = 0
+        earlier_violations = self.earlier_violations(addr[0])
+        reason = 'error'
         
         try:
             # Optimize TCP performance
             conn.setsockopt(socket.IPPROTO_TCP, socket.TCP_NODELAY, 1)
-            data = conn.recv(8)
+            try:
+                data = self.read_handshake_line(conn, self.handshake_timeout)
+                self.dump_frame('recv', data)
+            except socket.timeout:
+                self.handshake_timeouts += 1
+                self.logger.warning(f"Handshake timed out after {self.handshake_timeout}s, dropping {addr}")
+                reason = 'handshake_timeout'
+                return False
+            conn.settimeout(self.idle_timeout)
+            bytes_received += len(data)
+            tokens = data.decode(errors='replace').split()
+            greeting = tokens[0][:64] if tokens else ''
             if self.handshake(data, conn):  # Pass data and conn to handshake
                 self.logger.info("Handshake success")
+                # A resumed session restores earlier counts; only report what this connection delivers
+                recv_before = self.total_recv
+                self.logger.info(f"Session {self.session_id} started")
+                # Same message format on both sides so logs can be joined on the run ID
+                self.logger.info(f"Run ID: {self.session_id}")
+                handshaken = True
+                if self.stop_event:
+                    # Wake up regularly so a stop request doesn't wait for the client
+                    conn.settimeout(min(self.idle_timeout, 0.5))
+                last_data = time.time()
                 while True: 
-                    data = conn.recv(1024)
+                    try:
+                        data = conn.recv(1024)
+                    except socket.timeout:
+                        if self.stop_event and self.stop_event.is_set():
+                            self.logger.warning(f"Server stopping, closing the connection to {addr}")
+                            reason = 'stopped'
+                            break
+                        if time.time() - last_data < self.idle_timeout:
+                            continue
+                        self.idle_evictions += 1
+                        self.logger.warning(f"No data from {addr} for {self.idle_timeout}s, evicting")
+                        reason = 'idle_timeout'
+                        break
+                    self.dump_frame('recv', data)
+                    if not data:
+                        self.logger.warning(f"{addr} closed the connection without finishing")
+                        reason = 'peer_closed'
+                        break
+                    last_data = time.time()
+                    bytes_received += len(data)
 
-                    if data[0] == ord('R'):
-                        self.process_client_retransmission(data, conn)
-                        continue
                     if data[0] == ord('F'):
                         self.logger.info("Finished")
+                        self.finish_session(data, conn)
+                        reason = 'completed'
                         break
+                    if data[0] == ord('R'):
+                        self.process_client_retransmission(data, conn)
+                    else:
+                        self.process_client_data(data,conn)
 
-
-                    self.process_client_data(data,conn)
+                    violations = earlier_violations + self.session_violations
+                    if self.max_violations and violations >= self.max_violations:
+                        self.logger.warning(f"{addr} sent {violations} malformed frames, disconnecting")
+                        reason = 'protocol_violations'
+                        break
             else:
                 self.logger.warning("Handshake failed")
-                return  # Exit early if handshake fails
+                reason = 'handshake_failed'
+                return False  # Exit early if handshake fails
             
         except ConnectionResetError:
             self.logger.warning(f"Connection reset by {addr}")
+            reason = 'reset'
         except Exception as e:
-            self.logger.error(f"Connection error: {e}")
+            # Contain bugs triggered by one client's input to that connection
+            self.connection_errors += 1
+            self.logger.exception(f"Connection error: {e}")
         finally:
+            # Before closing, so the ban is in place by the time the client sees the disconnect
+            self.record_address_violations(addr[0])
             conn.close()
+            self.termination_reason = reason
+            self.write_audit_record({
+                'session_id': self.session_id,
+                'remote_addr': f"{addr[0]}:{addr[1]}",
+                'handshake': {'greeting': greeting, 'completed': handshaken, 'version': self.client_version,
+                              'options': self.client_options, 'window_size': self.window_size},
+                'start_time': started,
+                'end_time': time.time(),
+                'bytes_received': bytes_received,
+                'bytes_sent': self.bytes_sent - sent_before,
+                'packets_received': self.total_recv - recv_before,
+                'missing': len(self.missing_seqs),
+                'violations': self.session_violations,
+                'reason': reason
+            })
             self.logger.info(f"Connection from {addr} closed")
-            self.logger.info(f"Total packets received: {self.total_recv}")
-            self.logger.info(f"Missing numbers count: {len(self.missing_seqs)}")
-            self.save_seq_data_to_file()
+            if handshaken:
+                # A connection that never completed the handshake has no session to report or save,
+                # so stalled connections can't fill the disk with empty sequence data files
+                self.logger.info(f"Total packets received: {self.total_recv}")
+                self.logger.info(f"Missing numbers count: {len(self.missing_seqs)}")
+                if self.strict or self.protocol_violations:
+                    self.logger.info(f"Protocol violations: {self.protocol_violations}")
+                self.logger.info(f"Received as retransmissions: {self.retransmitted_recv} - "
+                                 f"spurious: {self.spurious_retransmissions}")
+                if self.out_of_range_seqs:
+                    self.logger.info(f"Out-of-range sequences: {self.out_of_range_seqs}")
+                if self.handshake_timeouts:
+                    self.logger.info(f"Handshake timeouts: {self.handshake_timeouts}")
+                if self.idle_evictions:
+                    self.logger.info(f"Idle evictions: {self.idle_evictions}")
+                latency = self.recovery_latency_stats()
+                if latency:
+                    self.logger.info(f"Recovery latency over {latency['count']} packets: "
+                                     f"mean {latency['mean']:.3f}s - p50 {latency['p50']:.3f}s - "
+                                     f"p95 {latency['p95']:.3f}s - p99 {latency['p99']:.3f}s - "
+                                     f"max {latency['max']:.3f}s")
+                outcome = 'completed' if reason == 'completed' else f"aborted ({reason})"
+                self.logger.info(f"Session {self.session_id} {outcome}")
+                if self.save_data:
+                    self.save_seq_data_to_file()
             self.logger.info("=" * 40)
+        return handshaken
     
+    def session_state(self):
+        """Capture the per-session tracker state so an aborted session can be resumed"""
+        with self.stats_lock:
+            return {
+                'total_recv': self.total_recv,
+                'retransmitted_recv': self.retransmitted_recv,
+                'block_seqs': self.block_seqs,
+                'spurious_retransmissions': self.spurious_retransmissions,
+                'missing_seqs': list(self.missing_seqs),
+                'missing_since': dict(self.missing_since),
+                'recovery_latencies': list(self.recovery_latencies),
+                'delivered_digest': self.delivered_digest.copy(),
+                'last_ack': self.last_ack,
+                'seqs_over_time': list(self.seqs_over_time),
+                'start_time': self.start_time
+            }
+
+    def expire_suspended_sessions(self):
+        """Forget suspended sessions older than session_ttl, and the oldest beyond max_suspended"""
+        now = time.time()
+        for session_id, (suspended_at, _) in list(self.suspended_sessions.items()):
+            if now - suspended_at > self.session_ttl:
+                del self.suspended_sessions[session_id]
+                self.logger.info(f"Suspended session {session_id} expired")
+        # Dicts keep insertion order, so the first entries are the oldest
+        while len(self.suspended_sessions) > self.max_suspended:
+            session_id = next(iter(self.suspended_sessions))
+            del self.suspended_sessions[session_id]
+            self.logger.info(f"Suspended session {session_id} dropped, more than {self.max_suspended} suspended")
+
+    def restore_session(self, state):
+        with self.stats_lock:
+            for name, value in state.items():
+                setattr(self, name, value)
+
+    def reset_session(self):
+        """Clear per-session tracking so the next client starts from zero"""
+        with self.stats_lock:
+            self.total_recv = 0
+            self.retransmitted_recv = 0
+            self.block_seqs = 0
+            self.spurious_retransmissions = 0
+            self.missing_seqs = []
+            self.missing_since = {}
+            self.recovery_latencies = []
+            self.delivered_digest = hashlib.blake2b(digest_size=16)
+            self.last_ack = 0
+            self.seqs_over_time = []
+            self.restart_metrics_stream()
+            self.start_time = time.time()
+
+    def recovery_latency_stats(self):
+        """Summarize how long lost packets waited before their retransmission arrived"""
+        latencies = sorted(self.recovery_latencies)
+        if not latencies:
+            return {}
+
+        def percentile(p):
+            return latencies[min(len(latencies) - 1, int(p / 100 * len(latencies)))]
+
+        return {
+            'count': len(latencies),
+            'mean': sum(latencies) / len(latencies),
+            'p50': percentile(50),
+            'p95': percentile(95),
+            'p99': percentile(99),
+            'max': latencies[-1]
+        }
+
+    def banned_addresses(self):
+        """Number of addresses currently banned"""
+        now = time.time()
+        return sum(1 for until in self.banned_until.values() if until > now)
+
+    def stats(self):
+        """Return a snapshot of the server's counters"""
+        total_recv, missing = self.snapshot_counters()
+        sent = total_recv + missing
+        return {
+            'session_id': self.session_id,
+            'received': total_recv,
+            'missing': missing,
+            'goodput': total_recv / sent if sent else 0,
+            'duration': time.time() - self.start_time,
+            'first_transmissions': total_recv - self.retransmitted_recv,
+            'retransmissions': self.retransmitted_recv,
+            'spurious_retransmissions': self.spurious_retransmissions,
+            'window_size': self.window_size,
+            'protocol_violations': self.protocol_violations,
+            'out_of_range_seqs': self.out_of_range_seqs,
+            'denied_connections': self.denied_connections,
+            'banned_connections': self.banned_connections,
+            'banned_addresses': self.banned_addresses(),
+            'violations_by_address': {ip: count for ip, (count, _) in self.address_violations.items()},
+            'handshake_timeouts': self.handshake_timeouts,
+            'connection_errors': self.connection_errors,
+            'idle_evictions': self.idle_evictions,
+            'bytes_sent': self.bytes_sent,
+            'recovery_latency': self.recovery_latency_stats(),
+            'delivered_digest': self.delivered_digest.hexdigest(),
+            'termination_reason': self.termination_reason
+        }
+
+    def serve(self, listener, stop_event=None):
+        """Serve client sessions on an already-listening socket.
+
+        Lets other programs and tests host the receiver in-process. Setting
+        stop_event makes serve() return without waiting for a client, and
+        closes the connection of a session in progress.
+        Returns after one session (or when stopped, with multi_session)
+        with a stats snapshot.
+        """
+        self.server = listener
+        self.stop_event = stop_event
+        if self.metrics_port:
+            self.start_metrics_server()
+        if stop_event:
+            # Poll so a stop request is noticed while blocked in accept()
+            listener.settimeout(0.5)
+
+        try:
+            while not (stop_event and stop_event.is_set()):
+                try:
+                    conn, addr = listener.accept()
+                except socket.timeout:
+                    continue
+                conn.settimeout(None)
+                self.expire_address_records()
+                refused = None
+                if not self.is_address_allowed(addr[0]):
+                    self.denied_connections += 1
+                    self.logger.warning(f"Denied connection from {addr} (denied so far: {self.denied_connections})")
+                    refused = 'denied'
+                elif self.is_banned(addr[0]):
+                    self.banned_connections += 1
+                    self.logger.warning(f"Refused connection from banned {addr} "
+                                        f"(refused so far: {self.banned_connections})")
+                    refused = 'banned'
+                if refused:
+                    conn.close()
+                    now = time.time()
+                    self.write_audit_record({
+                        'remote_addr': f"{addr[0]}:{addr[1]}",
+                        'start_time': now,
+                        'end_time': now,
+                        'reason': refused
+                    })
+                    continue
+                if self.handle_client(conn, addr):
+                    if not self.multi_session:
+                        break
+                    if self.termination_reason != 'completed':
+                        # Keep the tracker so the client can reconnect with session=<id>
+                        self.suspended_sessions[self.session_id] = (time.time(), self.session_state())
+                        self.expire_suspended_sessions()
+                        self.logger.info(f"Session {self.session_id} suspended for resume")
+                    # Stats were logged and saved when the session closed
+                    self.reset_session()
+        finally:
+            self.stop_timers()
+            self.stop_metrics_server()
+        return self.stats()
+
     def run(self):
-        """Run server in single-client mode"""
+        """Run the server until its session ends, returning the final stats snapshot"""
         self.logger.info(f"Server IP address: {self.get_ip_address()}")
 
         self.setup()
         
         try:
-            conn, addr = self.server.accept()
-            self.handle_client(conn, addr)
+            return self.serve(self.server)
         except Exception as e:
             self.logger.error(f"Error accepting connection: {e}")
 
@@ -231,7 +955,128 @@ class Server:
         finally:
             if self.server:
                 self.server.close()
+        return self.stats()
+
+def cidr(value):
+    """argparse type for --allow-cidr/--deny-cidr, so a malformed network is a usage error"""
+    try:
+        return ipaddress.ip_network(value, strict=False)
+    except ValueError as e:
+        raise argparse.ArgumentTypeError(str(e))
+
+def daemonize(pid_file):
+    """Detach from the terminal and record the daemon's PID in pid_file"""
+    # Must run before Server() is created: threads do not survive fork()
+    if os.fork() > 0:
+        sys.exit(0)
+    os.setsid()
+    if os.fork() > 0:
+        sys.exit(0)
+
+    devnull = os.open(os.devnull, os.O_RDWR)
+    for fd in (0, 1, 2):
+        os.dup2(devnull, fd)
+    os.close(devnull)
+
+    with open(pid_file, 'w') as f:
+        f.write(f"{os.getpid()}\n")
+    atexit.register(lambda: os.path.exists(pid_file) and os.remove(pid_file))
+    # Turn SIGTERM into the same clean shutdown path as Ctrl-C
+    signal.signal(signal.SIGTERM, signal.default_int_handler)
+
+def stop_daemon(pid_file):
+    """Signal the daemon recorded in pid_file to shut down"""
+    try:
+        with open(pid_file) as f:
+            pid = int(f.read().strip())
+        os.kill(pid, signal.SIGTERM)
+        print(f"Sent SIGTERM to server (pid {pid})")
+    except (OSError, ValueError) as e:
+        print(f"Could not stop server from {pid_file}: {e}")
+        sys.exit(1)
 
 if __name__ == '__main__':
-    server = Server()
-    server.run()
+    parser = argparse.ArgumentParser(description='TCP sliding window simulation server')
+    parser.add_argument('--allow-cidr', action='append', default=[], type=cidr,
+                        help='Only accept clients from this network (repeatable)')
+    parser.add_argument('--deny-cidr', action='append', default=[], type=cidr,
+                        help='Reject clients from this network (repeatable)')
+    parser.add_argument('--handshake-timeout', type=float, default=10.0,
+                        help='Seconds to wait for a client handshake before dropping it')
+    parser.add_argument('--idle-timeout', type=float, default=30.0,
+                        help='Seconds a connected client may stay silent before it is evicted')
+    parser.add_argument('--audit-log', help='Append a JSON record per connection to this file')
+    parser.add_argument('--strict', action='store_true',
+                        help='Reply to malformed frames with ERROR:<code> instead of skipping bad input')
+    parser.add_argument('--max-batch', type=int, default=MAX_BATCH,
+                        help=f'Most sequences accepted in one data block, at most {MAX_BATCH}')
+    parser.add_argument('--max-violations', type=int,
+                        help='Disconnect a client after this many protocol violations')
+    parser.add_argument('--ban-duration', type=float, default=0.0,
+                        help='Seconds to refuse an address disconnected by --max-violations (0 for no ban)')
+    parser.add_argument('--time-scale', type=float, default=1.0,
+                        help='Multiply all timers by this factor (e.g. 0.1 for faster sweeps)')
+    parser.add_argument('--gnuplot', action='store_true',
+                        help='Write a gnuplot script alongside the sequence data CSV')
+    parser.add_argument('--metrics-port', type=int,
+                        help='Stream per-interval stats as Server-Sent Events on this port')
+    parser.add_argument('--dump-wire', action='store_true',
+                        help='Log a hex/ASCII dump of every frame sent and received (rate-limited)')
+    parser.add_argument('--session-ttl', type=float, default=300.0,
+                        help='Seconds an aborted session can still be resumed (--multi-session)')
+    parser.add_argument('--max-suspended', type=int, default=100,
+                        help='Most aborted sessions kept for resume; the oldest are dropped first')
+    parser.add_argument('--multi-session', action='store_true',
+                        help='Keep serving new client sessions instead of exiting after one')
+    parser.add_argument('--quiet', action='store_true', help='Suppress all log output except errors')
+    parser.add_argument('--result-json', metavar='PATH',
+                        help="Write final stats as JSON to PATH ('-' for stdout)")
+    parser.add_argument('--log-file', help='Write logs to this file instead of the console')
+    parser.add_argument('--daemon', action='store_true', help='Run detached in the background')
+    parser.add_argument('--pid-file', default='server.pid', help='PID file used by --daemon and --stop')
+    parser.add_argument('--stop', action='store_true', help='Stop a server started with --daemon')
+    args = parser.parse_args()
+    if args.time_scale <= 0:
+        parser.error('--time-scale must be positive')
+    if args.idle_timeout <= 0:
+        # settimeout(0) would make the connection non-blocking and end every session at its first recv
+        parser.error('--idle-timeout must be positive')
+    for name in ('handshake_timeout', 'session_ttl', 'max_suspended', 'max_batch'):
+        # A zero handshake timeout drops every client before it can greet, a zero TTL or
+        # limit forgets every suspended session right away, and a zero batch rejects every block
+        if getattr(args, name) <= 0:
+            parser.error(f"--{name.replace('_', '-')} must be positive")
+    if args.max_batch > MAX_BATCH:
+        # A larger block would no longer fit in one read and be split into malformed frames
+        parser.error(f'--max-batch must be at most {MAX_BATCH}')
+    if args.ban_duration and not args.max_violations:
+        parser.error('--ban-duration requires --max-violations')
+
+    if args.stop:
+        stop_daemon(args.pid_file)
+        sys.exit(0)
+    if args.daemon:
+        if not args.log_file:
+            parser.error('--daemon requires --log-file')
+        # Resolve paths before detaching so they don't depend on how we were started
+        args.pid_file = os.path.abspath(args.pid_file)
+        args.log_file = os.path.abspath(args.log_file)
+        daemonize(args.pid_file)
+
+    server = Server(allow_cidrs=args.allow_cidr, deny_cidrs=args.deny_cidr,
+                    handshake_timeout=args.handshake_timeout, idle_timeout=args.idle_timeout,
+                    audit_file=args.audit_log, strict=args.strict, max_violations=args.max_violations,
+                    log_file=args.log_file, time_scale=args.time_scale, quiet=args.quiet,
+                    gnuplot=args.gnuplot, metrics_port=args.metrics_port,
+                    dump_wire=args.dump_wire, multi_session=args.multi_session,
+                    session_ttl=args.session_ttl, max_suspended=args.max_suspended,
+                    ban_duration=args.ban_duration, max_batch=args.max_batch)
+    result = server.run()
+
+    if args.result_json == '-':
+        print(json.dumps(result))
+    elif args.result_json:
+        with open(args.result_json, 'w') as f:
+            json.dump(result, f, indent=2)
+    # Non-zero exit lets batch scripts detect runs that didn't finish cleanly
+    sys.exit(0 if result['termination_reason'] == 'completed' else 1)
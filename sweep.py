@@ -0,0 +1,191 @@
+import argparse
+import concurrent.futures
+import csv
+import decimal
+import itertools
+import logging
+import math
+import random
+import socket
+import statistics
+import threading
+import time
+
+from client import PacketClient
+from server import MAX_BATCH, Server
+
+def decimal_places(text):
+    """Number of digits after the decimal point in a number as written, e.g. 3 for '0.001' or '1e-3'"""
+    return max(0, -decimal.Decimal(text.strip()).as_tuple().exponent)
+
+def parse_values(text, cast):
+    """Parse either a comma-separated list or a start:stop:step range; raises ValueError on bad input"""
+    if ':' in text:
+        parts = text.split(':')
+        if len(parts) != 3:
+            raise ValueError(f"range {text!r} must be start:stop:step")
+        start, stop, step = (cast(v) for v in parts)
+        if not all(math.isfinite(v) for v in (start, stop, step)):
+            raise ValueError(f"range {text!r} must have finite bounds and step")
+        if step <= 0:
+            raise ValueError(f"range {text!r} needs a positive step")
+        if start > stop:
+            raise ValueError(f"range {text!r} starts above its stop value")
+        count = int((stop - start) / step + 1e-9) + 1
+        if cast is int:
+            return [start + i * step for i in range(count)]
+        # Computing each value from start (rather than adding step repeatedly) and rounding to the
+        # precision the range was written with keeps 0.001:0.05:0.01 at 0.021 instead of 0.020999999999999998
+        places = max(decimal_places(parts[0]), decimal_places(parts[2]))
+        return [round(start + i * step, places) for i in range(count)]
+    return [cast(v) for v in text.split(',')]
+
+# Two-sided 95% Student t critical values by degrees of freedom
+T_95 = {1: 12.706, 2: 4.303, 3: 3.182, 4: 2.776, 5: 2.571, 6: 2.447, 7: 2.365, 8: 2.306,
+        9: 2.262, 10: 2.228, 15: 2.131, 20: 2.086, 25: 2.060, 30: 2.042}
+
+def confidence_interval(values):
+    """Return (mean, stddev, 95% CI half-width) for a list of samples"""
+    mean = statistics.mean(values)
+    if len(values) < 2:
+        return mean, 0.0, 0.0
+    stddev = statistics.stdev(values)
+    df = len(values) - 1
+    # Round down to the nearest tabulated df (conservative); fall back to normal for large n
+    t = T_95[max(k for k in T_95 if k <= df)] if df <= 30 else 1.96
+    return mean, stddev, t * stddev / len(values) ** 0.5
+
+def summarize(results):
+    """Aggregate repeated runs of each configuration into one summary record"""
+    groups = {}
+    for result in results:
+        groups.setdefault((result['drop_prob'], result['window_size']), []).append(result)
+
+    summary = []
+    for (drop_prob, window_size), runs in sorted(groups.items()):
+        record = {'drop_prob': drop_prob, 'window_size': window_size, 'runs': len(runs)}
+        for metric in ('goodput', 'duration'):
+            mean, stddev, ci = confidence_interval([run[metric] for run in runs])
+            record[f'{metric}_mean'] = mean
+            record[f'{metric}_stddev'] = stddev
+            record[f'{metric}_ci95'] = ci
+        summary.append(record)
+    return summary
+
+def run_once(drop_prob, window_size, max_packets, time_scale, seed=None):
+    """Run one client/server session in-process and return its result record"""
+    listener = socket.create_server(('127.0.0.1', 0))
+    port = listener.getsockname()[1]
+    server = Server(quiet=True, save_data=False, time_scale=time_scale)
+    server_stats = {}
+    server_thread = threading.Thread(
+        target=lambda: server_stats.update(server.serve(listener)), daemon=True)
+    server_thread.start()
+
+    # No drain: goodput is measured as of the last new packet, like earlier sweeps
+    client = PacketClient(port=port, max_packets=max_packets, window_size=window_size,
+                          drop_prob=drop_prob, time_scale=time_scale, seed=seed, drain_timeout=0)
+    start = time.time()
+    client.run()
+    duration = time.time() - start
+
+    server_thread.join(timeout=10)
+    listener.close()
+
+    return {
+        'run_id': server_stats.get('session_id'),
+        'drop_prob': drop_prob,
+        'window_size': client.window_size,  # As negotiated with the server
+        'max_packets': max_packets,
+        'seed': seed,
+        'client_sent': client.total_sent,
+        'client_unrecovered': len(client.dropped),
+        'received': server_stats.get('received', 0),
+        'missing': server_stats.get('missing', 0),
+        'goodput': server_stats.get('goodput', 0),
+        'duration': duration,
+        'completed': server_stats.get('termination_reason') == 'completed'
+    }
+
+def quiet_logging():
+    """Keep the per-run client/server output quiet, including in worker processes"""
+    logging.basicConfig(level=logging.ERROR, format='%(asctime)s - %(levelname)s - %(message)s')
+
+def main():
+    parser = argparse.ArgumentParser(description='Run the simulation over a grid of parameters')
+    parser.add_argument('--drop-probs', default='0.001,0.01,0.05,0.1',
+                        help='Drop probabilities as a list (0.01,0.05) or range (0.001:0.1:0.01)')
+    parser.add_argument('--window-sizes', default='10,100,500,1000',
+                        help=f'Window sizes as a list (100,500) or range (10:1000:100), at most {MAX_BATCH}')
+    parser.add_argument('--max-packets', type=int, default=50_000, help='Packets sent per run')
+    parser.add_argument('--time-scale', type=float, default=1.0, help='Timer scale factor for each run')
+    parser.add_argument('--sample', type=int, help='Run only a random subset of this many combinations')
+    parser.add_argument('--repeats', type=int, default=1,
+                        help='Runs per combination, each with a different seed')
+    parser.add_argument('--seed', type=int, default=0, help='Base seed; run k of a combination uses seed+k')
+    parser.add_argument('--summary', default='sweep_summary.csv',
+                        help='CSV file for mean/stddev/95%% CI per combination (with --repeats > 1)')
+    parser.add_argument('--jobs', type=int, default=1, help='Number of runs to execute concurrently')
+    parser.add_argument('--output', default='sweep_results.csv', help='CSV file for the result records')
+    args = parser.parse_args()
+    if args.time_scale <= 0:
+        parser.error('--time-scale must be positive')
+    if args.jobs < 1:
+        parser.error('--jobs must be at least 1')
+    if args.repeats < 1:
+        parser.error('--repeats must be at least 1')
+
+    # Configure logging before the client/server so their per-run output stays quiet
+    quiet_logging()
+
+    try:
+        drop_probs = parse_values(args.drop_probs, float)
+        window_sizes = parse_values(args.window_sizes, int)
+    except ValueError as e:
+        parser.error(str(e))
+    # Larger windows would be shrunk to the server's advertised window, recording the wrong size
+    too_large = [size for size in window_sizes if size > MAX_BATCH]
+    if too_large:
+        parser.error(f"window sizes above the server's limit of {MAX_BATCH}: {too_large}")
+    combos = list(itertools.product(drop_probs, window_sizes))
+    if args.sample and args.sample < len(combos):
+        # Drawn from --seed so the same subset can be run again
+        combos = random.Random(args.seed).sample(combos, args.sample)
+
+    runs = [(drop_prob, window_size, args.seed + k)
+            for drop_prob, window_size in combos for k in range(args.repeats)]
+
+    fieldnames = ['run_id', 'drop_prob', 'window_size', 'max_packets', 'seed', 'client_sent', 'client_unrecovered',
+                  'received', 'missing', 'goodput', 'duration', 'completed']
+    results = []
+    with open(args.output, 'w', newline='') as csvfile:
+        writer = csv.DictWriter(csvfile, fieldnames=fieldnames)
+        writer.writeheader()
+        # Separate processes, so concurrent runs don't share one interpreter lock and skew the timings
+        with concurrent.futures.ProcessPoolExecutor(max_workers=args.jobs, initializer=quiet_logging) as pool:
+            futures = [pool.submit(run_once, drop_prob, window_size, args.max_packets, args.time_scale, seed)
+                       for drop_prob, window_size, seed in runs]
+            for i, future in enumerate(concurrent.futures.as_completed(futures), 1):
+                result = future.result()
+                results.append(result)
+                writer.writerow(result)
+                csvfile.flush()
+                print(f"[{i}/{len(runs)}] drop={result['drop_prob']} window={result['window_size']} "
+                      f"seed={result['seed']} goodput={result['goodput']:.4f} time={result['duration']:.2f}s")
+
+    print(f"Saved {len(runs)} results to {args.output}")
+
+    if args.repeats > 1:
+        summary = summarize(results)
+        with open(args.summary, 'w', newline='') as csvfile:
+            writer = csv.DictWriter(csvfile, fieldnames=list(summary[0].keys()))
+            writer.writeheader()
+            writer.writerows(summary)
+        for record in summary:
+            print(f"drop={record['drop_prob']} window={record['window_size']}: "
+                  f"goodput {record['goodput_mean']:.4f} ± {record['goodput_ci95']:.4f}, "
+                  f"time {record['duration_mean']:.2f}s ± {record['duration_ci95']:.2f}s")
+        print(f"Saved summary of {len(summary)} configurations to {args.summary}")
+
+if __name__ == '__main__':
+    main()
@@ -0,0 +1,626 @@
+import json
+import logging
+import os
+import socket
+import tempfile
+import threading
+import time
+import unittest
+from unittest import mock
+
+from client import (EXIT_HANDSHAKE_REJECTED, EXIT_SEND_STALLED, MAX_RTO_BACKOFF, MarkovChannel, PacketClient,
+                    SendStalledError, ServerUnresponsiveError, parse_args)
+from server import Server
+from test_server import free_port, wait_for_threads
+
+def setUpModule():
+    logging.disable(logging.CRITICAL)
+
+def tearDownModule():
+    logging.disable(logging.NOTSET)
+
+
+class AbortingClient(PacketClient):
+    """Drops the connection at the end of the run instead of finishing the session"""
+    def finish(self):
+        pass
+
+
+class FlakyClient(PacketClient):
+    """Drops the connection once before a window is sent, once after a window is sent but before
+    its ACK is read, and once before a retransmission frame is sent"""
+    def __init__(self, **options):
+        super().__init__(**options)
+        self.windows = 0
+        self.drops = {'before_window', 'before_ack', 'before_retransmission'}
+
+    def drop(self, point):
+        if point not in self.drops:
+            return
+        self.drops.remove(point)
+        raise ConnectionResetError(f"test dropped the connection {point.replace('_', ' ')}")
+
+    def send_with_retry(self, data):
+        if data[:1].isdigit():
+            self.windows += 1
+            if self.windows == 3:
+                self.drop('before_window')
+        elif data[:1] == b'R':
+            self.drop('before_retransmission')
+        return super().send_with_retry(data)
+
+    def read_reply(self):
+        if self.windows == 6:
+            self.drop('before_ack')
+        return super().read_reply()
+
+
+class FakeSocket:
+    """Stands in for the server connection, answering each recv from a list of replies"""
+    def __init__(self, replies):
+        self.replies = list(replies)
+        self.sent = []
+        self.timeout = None
+
+    def send(self, data):
+        self.sent.append(bytes(data))
+        return len(data)
+
+    def recv(self, size):
+        reply = self.replies.pop(0)
+        if isinstance(reply, Exception):
+            raise reply
+        return reply
+
+    def settimeout(self, timeout):
+        self.timeout = timeout
+
+    def gettimeout(self):
+        return self.timeout
+
+    def close(self):
+        pass
+
+
+class ClientTest(unittest.TestCase):
+    def setUp(self):
+        self.baseline = set(threading.enumerate())
+        self.listener = socket.create_server(('127.0.0.1', 0))
+        self.addCleanup(self.listener.close)
+        self.port = self.listener.getsockname()[1]
+
+    def start_server(self, **options):
+        server = Server(quiet=True, save_data=False, time_scale=0.01, **options)
+        stop_event = threading.Event()
+        thread = threading.Thread(target=server.serve, args=(self.listener, stop_event))
+        thread.start()
+
+        def stop():
+            stop_event.set()
+            thread.join(timeout=5)
+        self.addCleanup(stop)
+        return server
+
+    def client(self, cls=PacketClient, **options):
+        return cls(port=self.port, transmit_delay=0.001, time_scale=0.01, seed=1, **options)
+
+    def test_digest_matches_server(self):
+        self.start_server()
+        client = self.client(max_packets=5000)
+        client.run()
+        self.assertEqual(client.exit_code, 0)
+        self.assertEqual(client.server_stats['delivered_digest'], client.delivered_digest.hexdigest())
+        self.assertEqual(client.server_stats['missing'], 0)
+
+    def test_result_record(self):
+        self.start_server()
+        client = self.client(max_packets=2000, quiet=True)
+        client.run()
+        result = json.loads(json.dumps(client.result()))
+        self.assertEqual(result['exit_code'], 0)
+        self.assertEqual(result['run_id'], client.server_stats['session_id'])
+        self.assertGreaterEqual(result['sent'], 2000)
+        self.assertEqual(result['unrecovered'], 0)
+        self.assertEqual(result['server_stats']['received'], 2000)
+        self.assertGreater(result['duration'], 0)
+
+    def test_resumed_session_digest_matches_server(self):
+        server = self.start_server(multi_session=True)
+        first = self.client(AbortingClient, max_packets=3000, drain_timeout=0)
+        first.run()
+        deadline = time.time() + 5
+        while first.run_id not in server.suspended_sessions and time.time() < deadline:
+            time.sleep(0.01)
+
+        second = self.client(max_packets=5000, resume_session=first.run_id)
+        second.run()
+        self.assertEqual(second.exit_code, 0)
+        self.assertEqual(second.run_id, first.run_id)
+        # The second process only sends what the server hasn't recorded yet
+        self.assertEqual(second.resumed_from, 3000)
+        self.assertEqual(second.server_stats['delivered_digest'], second.delivered_digest.hexdigest())
+
+    def test_resume_from_checkpoint_retransmits_earlier_losses(self):
+        server = self.start_server(multi_session=True)
+        fd, path = tempfile.mkstemp(suffix='.json')
+        os.close(fd)
+        self.addCleanup(os.remove, path)
+        # No retransmissions, so the aborted run leaves its losses queued in the checkpoint
+        first = self.client(AbortingClient, max_packets=3000, drop_prob=0.05, drain_timeout=0,
+                            retransmit_interval=1000, checkpoint_file=path)
+        first.run()
+        deadline = time.time() + 5
+        while first.run_id not in server.suspended_sessions and time.time() < deadline:
+            time.sleep(0.01)
+        self.assertGreater(len(first.dropped), 0)
+
+        second = self.client(max_packets=5000, drop_prob=0.05, resume_checkpoint=path)
+        second.run()
+        self.assertEqual(second.exit_code, 0)
+        self.assertEqual(second.run_id, first.run_id)
+        self.assertEqual(second.inherited_missing, 0)
+        self.assertEqual(second.server_stats['missing'], 0)
+        self.assertEqual(second.unrecovered(), 0)
+        self.assertEqual(second.server_stats['delivered_digest'], second.delivered_digest.hexdigest())
+
+    def test_reconnect_resends_only_what_the_server_did_not_record(self):
+        self.start_server(multi_session=True)
+        client = self.client(FlakyClient, max_packets=2000, window_size=100, drop_prob=0.05)
+        client.run()
+        self.assertEqual(client.drops, set())
+        self.assertEqual(client.exit_code, 0)
+        self.assertEqual(client.reconnects, 3)
+        self.assertEqual(client.server_stats['missing'], 0)
+        # A window resent although it was recorded, or a retransmission sent twice, would count twice
+        self.assertEqual(client.server_stats['received'], 2000)
+        self.assertEqual(client.server_stats['spurious_retransmissions'], 0)
+        self.assertEqual(client.server_stats['delivered_digest'], client.delivered_digest.hexdigest())
+
+    def test_migration_keeps_the_session(self):
+        self.start_server(multi_session=True)
+        client = self.client(max_packets=2000, window_size=100, drop_prob=0.05, migrate_every=3)
+        client.run()
+        self.assertEqual(client.exit_code, 0)
+        self.assertEqual(client.migrations, 6)
+        self.assertEqual(client.reconnects, 0)
+        # Losses queued before a migration are retransmitted over a later connection
+        self.assertEqual(client.server_stats['missing'], 0)
+        self.assertEqual(client.server_stats['received'], 2000)
+        self.assertEqual(client.server_stats['delivered_digest'], client.delivered_digest.hexdigest())
+
+    def test_unsupported_seq_bits_fails_the_run(self):
+        # A server that never confirms seq_bits=32
+        def answer():
+            conn, _ = self.listener.accept()
+            with conn:
+                conn.recv(256)
+                conn.sendall(b'success/2 session=0123456789ab window=1000\n')
+                conn.recv(256)
+        thread = threading.Thread(target=answer)
+        thread.start()
+        client = self.client(max_packets=100, max_seq=2**32)
+        client.run()
+        thread.join(timeout=5)
+        self.assertEqual(client.exit_code, EXIT_HANDSHAKE_REJECTED)
+        self.assertEqual(client.total_sent, 0)
+
+    def test_original_server_fails_the_handshake(self):
+        # The original server reads an 8-byte greeting and hangs up unless it is "network\n"
+        def answer():
+            conn, _ = self.listener.accept()
+            with conn:
+                if conn.recv(8).strip() == b'network':
+                    conn.sendall(b'success\n')
+        thread = threading.Thread(target=answer)
+        thread.start()
+        client = self.client(max_packets=100)
+        client.run()
+        thread.join(timeout=5)
+        self.assertEqual(client.exit_code, EXIT_HANDSHAKE_REJECTED)
+        self.assertEqual(client.total_sent, 0)
+
+    def test_low_rate_keeps_the_connection_alive(self):
+        server = self.start_server()
+        # A whole window at 10 packets/s would leave the server idle for 50s, past its 30s timeout
+        client = self.client(max_packets=2000, rate=10)
+        client.run()
+        self.assertEqual(client.window_size, 50)
+        self.assertEqual(client.exit_code, 0)
+        self.assertEqual(client.server_stats['received'], 2000)
+        self.assertEqual(server.idle_evictions, 0)
+
+    def test_run_stops_every_thread(self):
+        self.start_server()
+        client = self.client(max_packets=2000, metrics_port=free_port())
+        client.run()
+        self.assertEqual(client.exit_code, 0)
+        self.assertIsNone(client.metrics_server)
+        # Stop the server too, then nothing started by the test may still be running
+        self.doCleanups()
+        self.assertEqual(wait_for_threads(self.baseline), [])
+
+
+
+class RetransmissionTimeoutTest(unittest.TestCase):
+    def test_rto_follows_smoothed_rtt_and_variance(self):
+        client = PacketClient()
+        client.update_rto(2.0)
+        self.assertEqual((client.srtt, client.rttvar), (2.0, 1.0))
+        self.assertAlmostEqual(client.ack_timeout, 6.0)
+        client.update_rto(4.0)
+        self.assertAlmostEqual(client.rttvar, 1.25)
+        self.assertAlmostEqual(client.srtt, 2.25)
+        self.assertAlmostEqual(client.ack_timeout, 7.25)
+
+    def test_rto_is_clamped(self):
+        client = PacketClient()
+        client.update_rto(0.001)
+        self.assertEqual(client.ack_timeout, client.min_rto)
+        client.update_rto(100.0)
+        self.assertEqual(client.ack_timeout, client.max_rto)
+
+
+class BackoffTest(unittest.TestCase):
+    def test_timeouts_double_the_rto_up_to_the_cap(self):
+        client = PacketClient(max_ack_timeouts=100)
+        rtos = []
+        for _ in range(MAX_RTO_BACKOFF + 2):
+            client.record_ack_timeout()
+            rtos.append(client.ack_timeout)
+        self.assertEqual(rtos[:5], [4.0, 8.0, 16.0, 32.0, 60.0])
+        self.assertEqual(rtos[-1], client.max_rto)
+
+    def test_backoff_stops_after_max_rto_backoff(self):
+        client = PacketClient(max_ack_timeouts=100)
+        client.max_rto = float('inf')
+        for _ in range(MAX_RTO_BACKOFF + 3):
+            client.record_ack_timeout()
+        self.assertEqual(client.ack_timeout, 2.0 * 2**MAX_RTO_BACKOFF)
+
+    def test_gives_up_after_max_ack_timeouts(self):
+        client = PacketClient(max_ack_timeouts=2)
+        client.record_ack_timeout()
+        with self.assertRaises(ServerUnresponsiveError):
+            client.record_ack_timeout()
+
+    def test_ack_after_a_timeout_is_not_timed(self):
+        client = PacketClient(window_size=10, drop_prob=0, transmit_delay=0)
+        client.socket = FakeSocket([socket.timeout(), b'10', b'20'])
+        client.handle_transmit()
+        self.assertTrue(client.rtt_ambiguous)
+        client.handle_transmit()
+        # Karn: the ACK may belong to the window that timed out
+        self.assertEqual(client.rtt_samples, [])
+        self.assertFalse(client.rtt_ambiguous)
+        client.handle_transmit()
+        self.assertEqual(len(client.rtt_samples), 1)
+
+
+
+class AckTest(unittest.TestCase):
+    def test_out_of_range_ack_is_ignored(self):
+        client = PacketClient(window_size=10, drop_prob=0, transmit_delay=0)
+        # Two unterminated version 1 ACKs read together
+        client.socket = FakeSocket([b'65535' + b'9', b'9'])
+        client.handle_transmit()
+        self.assertEqual(client.last_ack, -1)
+        self.assertEqual(client.invalid_acks, 1)
+        # The window is sent again from the last valid ACK
+        client.handle_transmit()
+        self.assertTrue(client.socket.sent[1].startswith(b'0:'))
+        self.assertEqual(client.last_ack, 9)
+
+    def test_acks_read_together_are_split_on_newlines(self):
+        # In 32-bit mode two run-together ACKs would still be inside the sequence space
+        client = PacketClient(window_size=10, drop_prob=0, transmit_delay=0, max_seq=2**32)
+        client.protocol_version = 2
+        client.last_ack = 12335
+        client.socket = FakeSocket([b'12345\n' + b'12355\n'])
+        client.handle_transmit()
+        self.assertEqual(client.last_ack, 12345)
+        client.handle_transmit()
+        self.assertTrue(client.socket.sent[1].startswith(b'12346:'))
+        self.assertEqual(client.last_ack, 12355)
+        self.assertEqual(client.invalid_acks, 0)
+
+    def test_partial_ack_waits_for_its_newline(self):
+        client = PacketClient(window_size=10, drop_prob=0, transmit_delay=0)
+        client.protocol_version = 2
+        client.socket = FakeSocket([b'9', b'\n'])
+        client.handle_transmit()
+        self.assertEqual(client.last_ack, 9)
+        self.assertEqual(client.recv_buffer, b'')
+
+class CheckpointTest(unittest.TestCase):
+    def checkpointed_client(self):
+        client = PacketClient(seed=1)
+        client.first_sent = client.total_sent = 1000
+        client.dropped = [(5, 0), (17, 1)]
+        client.first_dropped = 2
+        fd, path = tempfile.mkstemp(suffix='.json')
+        os.close(fd)
+        self.addCleanup(os.remove, path)
+        client.checkpoint_file = path
+        client.write_checkpoint()
+
+        resumed = PacketClient()
+        resumed.checkpoint = resumed.read_checkpoint(path)
+        return client, resumed
+
+    def test_windows_after_the_checkpoint_stay_missing(self):
+        client, resumed = self.checkpointed_client()
+        # Two more windows reached the server after the checkpoint, losing three packets between them
+        resumed.resume_point = (1499, 2000, 5, '00' * 16)
+        resumed.restore_checkpoint()
+        self.assertEqual(resumed.dropped, [(5, 0), (17, 1)])
+        self.assertEqual(resumed.resumed_from + resumed.first_sent, 2000)
+        self.assertEqual(resumed.inherited_missing, 3)
+        self.assertEqual(resumed.unrecovered(), 5)
+        self.assertEqual(resumed.rng.random(), client.rng.random())
+
+    def test_checkpoint_ahead_of_the_server_is_refused(self):
+        _, resumed = self.checkpointed_client()
+        resumed.resume_point = (499, 500, 0, '00' * 16)
+        with self.assertRaises(ValueError):
+            resumed.restore_checkpoint()
+
+
+class PacingTest(unittest.TestCase):
+    def setUp(self):
+        self.now = 1000.0
+        patcher = mock.patch('time.time', lambda: self.now)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.sleeps = []
+        patcher = mock.patch('time.sleep', self.sleep)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.client = PacketClient(window_size=50, rate=100)
+
+    def sleep(self, seconds):
+        self.sleeps.append(seconds)
+        self.now += seconds
+
+    def test_full_bucket_sends_a_window_without_waiting(self):
+        self.client.pace(50)
+        self.assertEqual(self.sleeps, [])
+        self.assertEqual(self.client.tokens, 0)
+
+    def test_empty_bucket_waits_for_enough_tokens(self):
+        self.client.pace(50)
+        self.client.pace(20)
+        self.assertEqual(self.sleeps, [0.2])
+        self.now += 0.1
+        self.client.pace(10)
+        # 0.1s refilled exactly the ten tokens needed
+        self.assertEqual(self.sleeps, [0.2])
+
+    def test_bucket_holds_at_most_one_window(self):
+        self.client.pace(50)
+        self.now += 60
+        self.client.pace(50)
+        self.client.pace(1)
+        self.assertEqual(len(self.sleeps), 1)
+
+    def test_window_is_reduced_to_the_rate(self):
+        client = PacketClient(window_size=500, rate=20, retransmit_interval=5.0)
+        self.assertEqual(client.window_size, 100)
+        self.assertEqual(client.tokens, 100)
+
+    def test_unpaced_without_rate(self):
+        client = PacketClient(window_size=50)
+        client.pace(10_000)
+        self.assertEqual(self.sleeps, [])
+
+
+class StalledSocket(FakeSocket):
+    """A server that stopped reading: every send times out"""
+    def send(self, data):
+        raise socket.timeout()
+
+
+class SendStalledTest(unittest.TestCase):
+    def client(self, **options):
+        client = PacketClient(transmit_delay=0, send_retries=1, **options)
+        client.socket = StalledSocket([])
+        return client
+
+    def test_stalled_retransmission_keeps_its_packets_queued(self):
+        client = self.client(drop_prob=0)
+        client.dropped = [(1, 0), (2, 0), (3, 0)]
+        with self.assertRaises(SendStalledError):
+            client.handle_retransmit()
+        self.assertEqual(client.dropped, [(1, 0), (2, 0), (3, 0)])
+        self.assertEqual(client.total_sent, 0)
+        self.assertEqual(client.unrecovered(), 3)
+
+    def test_stalled_window_is_not_counted_as_sent(self):
+        client = self.client(window_size=10, drop_prob=1)
+        with self.assertRaises(SendStalledError):
+            client.handle_transmit()
+        self.assertEqual(client.dropped, [])
+        self.assertEqual((client.total_sent, client.first_sent, client.first_dropped), (0, 0, 0))
+
+    def test_stalled_send_ends_the_run(self):
+        client = self.client(window_size=10)
+        # Skip the handshake and go straight to the send loop
+        client.connect = lambda: True
+        client.run()
+        self.assertEqual(client.exit_code, EXIT_SEND_STALLED)
+
+
+class AbandonTest(unittest.TestCase):
+    def client(self, **options):
+        client = PacketClient(transmit_delay=0, **options)
+        client.socket = FakeSocket([])
+        return client
+
+    def test_packet_is_abandoned_after_max_retransmits(self):
+        client = self.client(drop_prob=1, max_retransmits=3)
+        client.dropped = [(7, 0)]
+        for _ in range(3):
+            client.handle_retransmit()
+        self.assertEqual(client.dropped, [])
+        self.assertEqual(client.abandoned, 1)
+        self.assertEqual(client.unrecovered(), 1)
+
+    def test_attempts_are_counted_per_queued_packet(self):
+        # The same sequence number queued again after a wrap starts its own count
+        client = self.client(drop_prob=1, max_retransmits=3)
+        client.dropped = [(7, 2), (7 + client.max_seq, 0)]
+        client.handle_retransmit()
+        self.assertEqual(client.abandoned, 1)
+        self.assertEqual(client.dropped, [(7 + client.max_seq, 1)])
+
+    def test_no_limit_keeps_retrying(self):
+        client = self.client(drop_prob=1)
+        client.dropped = [(7, 0)]
+        for _ in range(10):
+            client.handle_retransmit()
+        self.assertEqual(client.dropped, [(7, 10)])
+        self.assertEqual(client.abandoned, 0)
+
+    def test_delivered_retransmission_leaves_the_queue(self):
+        client = self.client(drop_prob=0, max_retransmits=3)
+        client.dropped = [(7, 2)]
+        client.handle_retransmit()
+        self.assertEqual(client.dropped, [])
+        self.assertEqual(client.abandoned, 0)
+        self.assertEqual(client.socket.sent, [b'R\x00\x07'])
+
+
+
+class MarkovChannelTest(unittest.TestCase):
+    @staticmethod
+    def chain(losses, transitions):
+        return MarkovChannel([{'name': str(i), 'loss': loss, 'transitions': row}
+                              for i, (loss, row) in enumerate(zip(losses, transitions))])
+
+    def test_expected_loss_weights_states_by_stationary_probability(self):
+        # Gilbert-Elliott: stationary probabilities 10/11 and 1/11
+        channel = self.chain([0.0, 0.5], [[0.99, 0.01], [0.10, 0.90]])
+        self.assertAlmostEqual(channel.expected_loss(), 0.5 / 11)
+
+    def test_expected_loss_of_a_periodic_chain(self):
+        # Alternates between the middle state and one of the outer two, so it is in the middle half the time
+        channel = self.chain([0.0, 1.0, 0.0], [[0, 1, 0], [0.5, 0, 0.5], [0, 1, 0]])
+        self.assertAlmostEqual(channel.expected_loss(), 0.5)
+
+    def test_invalid_scenarios_raise(self):
+        cases = [
+            ([0.0, 0.5], [[0.9, 0.2], [0.1, 0.9]]),  # First row sums to 1.1
+            ([0.0, 0.5], [[1.0], [0.1, 0.9]]),  # Too few transitions
+            ([0.0, 1.5], [[0.9, 0.1], [0.1, 0.9]]),  # Loss above 1
+        ]
+        for losses, transitions in cases:
+            with self.subTest(transitions=transitions, losses=losses):
+                with self.assertRaises(ValueError):
+                    self.chain(losses, transitions)
+
+    def test_malformed_channel_file_is_a_usage_error(self):
+        for text in ('{"states": [{"loss": 0.1, "transitions": [0.5]}]}', '{"initial": 0}', '[1, 2]', '{'):
+            with self.subTest(text=text):
+                fd, path = tempfile.mkstemp(suffix='.json')
+                with os.fdopen(fd, 'w') as f:
+                    f.write(text)
+                self.addCleanup(os.remove, path)
+                with mock.patch('sys.stderr'), self.assertRaises(SystemExit) as raised:
+                    parse_args(['--channel', path])
+                self.assertEqual(raised.exception.code, 2)
+
+    def test_channel_file_is_loaded(self):
+        fd, path = tempfile.mkstemp(suffix='.json')
+        with os.fdopen(fd, 'w') as f:
+            json.dump({'initial': 1, 'states': [{'loss': 0.0, 'transitions': [0.5, 0.5]},
+                                                {'loss': 0.2, 'transitions': [0.5, 0.5]}]}, f)
+        self.addCleanup(os.remove, path)
+        channel = parse_args(['--channel', path]).channel
+        self.assertEqual(channel.state, 1)
+        self.assertAlmostEqual(channel.expected_loss(), 0.1)
+
+
+class ArgumentTest(unittest.TestCase):
+    def test_non_positive_values_are_usage_errors(self):
+        for flag in ('--window-size', '--max-packets', '--send-retries', '--rate', '--retransmit-interval',
+                     '--time-scale', '--max-ack-timeouts', '--max-retransmits'):
+            for value in ('0', '-1'):
+                with self.subTest(flag=flag, value=value):
+                    with mock.patch('sys.stderr'), self.assertRaises(SystemExit) as raised:
+                        parse_args([flag, value])
+                    self.assertEqual(raised.exception.code, 2)
+
+    def test_rate_below_one_packet_per_retransmit_interval_is_a_usage_error(self):
+        with mock.patch('sys.stderr'), self.assertRaises(SystemExit) as raised:
+            parse_args(['--rate', '0.1', '--retransmit-interval', '5'])
+        self.assertEqual(raised.exception.code, 2)
+
+    def test_out_of_range_values_are_usage_errors(self):
+        for flag, value in (('--drop-prob', '-0.1'), ('--drop-prob', '1.5'), ('--transmit-delay', '-1'),
+                            ('--reconnect-attempts', '-1')):
+            with self.subTest(flag=flag, value=value):
+                with mock.patch('sys.stderr'), self.assertRaises(SystemExit) as raised:
+                    parse_args([flag, value])
+                self.assertEqual(raised.exception.code, 2)
+
+    def test_defaults_are_accepted(self):
+        args = parse_args([])
+        self.assertEqual(args.window_size, 500)
+        self.assertIsNone(args.rate)
+
+    def test_zero_reconnect_attempts_is_accepted(self):
+        self.assertEqual(parse_args(['--reconnect-attempts', '0']).reconnect_attempts, 0)
+
+    def test_defaults_match_the_client(self):
+        args = parse_args([])
+        client = PacketClient()
+        self.assertEqual(2**args.seq_bits, client.max_seq)
+        self.assertEqual(args.drop_prob, client.drop_prob)
+        self.assertEqual(args.retransmit_interval, client.retransmit_interval)
+        self.assertEqual(args.drain_timeout, client.drain_timeout)
+
+class ConfigFileTest(unittest.TestCase):
+    def config(self, suffix, text):
+        fd, path = tempfile.mkstemp(suffix=suffix)
+        with os.fdopen(fd, 'w') as f:
+            f.write(text)
+        self.addCleanup(os.remove, path)
+        return path
+
+    def assertUsageError(self, argv):
+        with mock.patch('sys.stderr'), self.assertRaises(SystemExit) as raised:
+            parse_args(argv)
+        self.assertEqual(raised.exception.code, 2)
+
+    def test_values_are_converted_and_flags_override_them(self):
+        path = self.config('.json', '{"window-size": "200", "drop-prob": 0.05, "seq-bits": 32}')
+        args = parse_args(['--config', path, '--drop-prob', '0.1'])
+        self.assertEqual(args.window_size, 200)
+        self.assertEqual(args.seq_bits, 32)
+        self.assertEqual(args.drop_prob, 0.1)
+
+    def test_flags_take_booleans(self):
+        self.assertTrue(parse_args(['--config', self.config('.json', '{"quiet": true}')]).quiet)
+        self.assertFalse(parse_args(['--config', self.config('.yaml', 'quiet: false')]).quiet)
+
+    def test_invalid_files_are_usage_errors(self):
+        cases = [
+            ('.json', '{"window-size": 1.5}'),
+            ('.json', '{"seq-bits": 24}'),
+            ('.json', '{"no-such-flag": 1}'),
+            ('.json', '{"quiet": "false"}'),
+            ('.json', '{"quiet": 1}'),
+            ('.json', '{"config": "other.json"}'),
+            ('.json', '[1, 2]'),
+            ('.json', '{"window-size": '),
+            ('.yaml', 'window-size: [1'),
+            ('.yaml', '- 1\n- 2\n'),
+        ]
+        for suffix, text in cases:
+            with self.subTest(text=text):
+                self.assertUsageError(['--config', self.config(suffix, text)])
+
+    def test_missing_file_is_a_usage_error(self):
+        self.assertUsageError(['--config', '/nonexistent/experiment.json'])
+
+if __name__ == '__main__':
+    unittest.main()
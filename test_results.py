@@ -0,0 +1,56 @@
+import json
+import os
+import tempfile
+import unittest
+
+from results import load_trace, merge
+
+SERVER = {'session_id': 'abc123', 'received': 990, 'missing': 10, 'retransmissions': 40,
+          'delivered_digest': 'd1', 'goodput': 0.99, 'termination_reason': 'completed'}
+CLIENT = {'run_id': 'abc123', 'exit_code': 0, 'sent': 1040, 'unrecovered': 10, 'retransmissions': 40,
+          'delivered_digest': 'd1'}
+
+
+class MergeTest(unittest.TestCase):
+    def test_reconciles_both_sides(self):
+        report = merge(SERVER, CLIENT)
+        self.assertEqual(report['run_id'], 'abc123')
+        reconciliation = report['reconciliation']
+        self.assertTrue(reconciliation['missing_matches'])
+        self.assertTrue(reconciliation['digest_matches'])
+        self.assertTrue(reconciliation['completed'])
+        self.assertEqual(report['client'], CLIENT)
+        self.assertEqual(report['server'], SERVER)
+
+    def test_flags_disagreement(self):
+        report = merge(SERVER, {**CLIENT, 'unrecovered': 9, 'delivered_digest': 'd2'})
+        self.assertFalse(report['reconciliation']['missing_matches'])
+        self.assertFalse(report['reconciliation']['digest_matches'])
+
+    def test_refuses_results_of_different_runs(self):
+        with self.assertRaises(ValueError):
+            merge(SERVER, {**CLIENT, 'run_id': 'other'})
+        with self.assertRaises(ValueError):
+            merge(SERVER, CLIENT, ({'other'}, {}))
+
+    def test_trace_is_joined_on_its_run_id(self):
+        records = [
+            {'qlog_version': '0.3'},
+            {'name': 'connectivity:connection_started', 'data': {'run_id': 'abc123'}},
+            {'name': 'transport:packet_sent', 'data': {}},
+            {'name': 'transport:packet_sent', 'data': {}},
+            {'name': 'recovery:packet_lost', 'data': {}},
+            {'name': 'transport:packet_sent', 'data': {'trigger': 'retransmit_timeout'}},
+        ]
+        fd, path = tempfile.mkstemp(suffix='.sqlog')
+        with os.fdopen(fd, 'w') as f:
+            f.writelines('\x1e' + json.dumps(record) + '\n' for record in records)
+        self.addCleanup(os.remove, path)
+
+        report = merge(SERVER, CLIENT, load_trace(path))
+        self.assertEqual(report['trace'], {'path': path, 'packets_sent': 3, 'packets_lost': 1,
+                                           'retransmissions': 1})
+
+
+if __name__ == '__main__':
+    unittest.main()
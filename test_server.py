@@ -0,0 +1,367 @@
+import argparse
+import json
+import logging
+import os
+import socket
+import subprocess
+import sys
+import tempfile
+import threading
+import time
+import unittest
+import urllib.request
+from unittest import mock
+
+from server import MAX_BATCH, MAX_TRACKED_ADDRESSES, Server, cidr
+
+def setUpModule():
+    logging.disable(logging.CRITICAL)
+
+def tearDownModule():
+    logging.disable(logging.NOTSET)
+
+def free_port():
+    with socket.create_server(('127.0.0.1', 0)) as s:
+        return s.getsockname()[1]
+
+def wait_for_threads(baseline, timeout=5.0):
+    """Return the threads started since baseline that are still alive after timeout"""
+    deadline = time.time() + timeout
+    while True:
+        leaked = [t for t in threading.enumerate() if t not in baseline and t.is_alive()]
+        if not leaked or time.time() > deadline:
+            return leaked
+        time.sleep(0.05)
+
+
+class ServerTestCase(unittest.TestCase):
+    """Hosts a Server on an ephemeral port with serve() running in a thread"""
+
+    server_options = {}
+
+    def setUp(self):
+        self.baseline = set(threading.enumerate())
+        self.listener = socket.create_server(('127.0.0.1', 0))
+        self.port = self.listener.getsockname()[1]
+        self.server = Server(quiet=True, save_data=False, time_scale=0.01, **self.server_options)
+        self.stop_event = threading.Event()
+        self.server_stats = {}
+        self.server_thread = threading.Thread(
+            target=lambda: self.server_stats.update(self.server.serve(self.listener, self.stop_event)))
+        self.server_thread.start()
+
+    def tearDown(self):
+        self.stop_event.set()
+        self.server_thread.join(timeout=5)
+        self.listener.close()
+
+    def connect(self, greeting):
+        conn = socket.create_connection(('127.0.0.1', self.port), timeout=5)
+        self.addCleanup(conn.close)
+        conn.sendall(greeting)
+        return conn, self.read_line(conn)
+
+    @staticmethod
+    def read_line(conn):
+        data = b''
+        while not data.endswith(b'\n'):
+            chunk = conn.recv(256)
+            if not chunk:
+                break
+            data += chunk
+        return data.decode().strip()
+
+
+class HandshakeTest(ServerTestCase):
+    server_options = {'multi_session': True}
+
+    def test_negotiates_down_to_supported_version(self):
+        _, reply = self.connect(b'network/99\n')
+        status, _, detail = reply.partition('/')
+        self.assertEqual(status, 'success')
+        self.assertEqual(detail.split()[0], '2')
+
+    def test_bare_greeting_is_version_1(self):
+        _, reply = self.connect(b'network\n')
+        self.assertEqual(reply, 'success')
+
+    def test_only_version_2_acks_are_terminated(self):
+        for greeting, ack in ((b'network\n', b'2'), (b'network/2\n', b'2\n')):
+            with self.subTest(greeting=greeting):
+                conn, _ = self.connect(greeting)
+                conn.sendall(b'1:11')
+                self.assertEqual(conn.recv(64), ack)
+                conn.close()
+
+    def test_negotiates_32_bit_sequences(self):
+        _, reply = self.connect(b'network/2 seq_bits=32\n')
+        self.assertIn('seq_bits=32', reply.split())
+        self.assertEqual(self.server.max_seq, 2**32)
+
+    def test_rejects_unsupported_seq_bits(self):
+        _, reply = self.connect(b'network/2 seq_bits=24\n')
+        self.assertTrue(reply.startswith('reject/bad_option '), reply)
+
+    def test_rejections(self):
+        cases = [
+            (b'hello\n', 'bad_greeting'),
+            (b'network/x\n', 'bad_version'),
+            (b'network/0\n', 'unsupported_version'),
+        ]
+        for greeting, code in cases:
+            with self.subTest(greeting=greeting):
+                _, reply = self.connect(greeting)
+                self.assertTrue(reply.startswith(f'reject/{code} '), reply)
+
+
+class HandshakeTimeoutTest(ServerTestCase):
+    server_options = {'multi_session': True}
+
+    def test_stalled_connections_save_no_session_data(self):
+        self.server.save_data = True
+        with mock.patch.object(self.server, 'save_seq_data_to_file') as save:
+            for _ in range(3):
+                conn = socket.create_connection(('127.0.0.1', self.port), timeout=5)
+                self.addCleanup(conn.close)
+                # Never greets, so the server drops it after the handshake timeout
+                self.assertEqual(conn.recv(64), b'')
+            self.assertEqual(self.server.handshake_timeouts, 3)
+            save.assert_not_called()
+
+
+class AuditTest(ServerTestCase):
+    def setUp(self):
+        fd, self.audit_file = tempfile.mkstemp(suffix='.jsonl')
+        os.close(fd)
+        self.addCleanup(os.remove, self.audit_file)
+        self.server_options = {'multi_session': True, 'audit_file': self.audit_file}
+        super().setUp()
+
+    def test_records_only_this_connections_handshake(self):
+        conn, _ = self.connect(b'network/2 seq_bits=32\n')
+        conn.close()
+        self.connect(b'hello\n')
+        deadline = time.time() + 5
+        while time.time() < deadline:
+            with open(self.audit_file) as f:
+                records = [json.loads(line) for line in f]
+            if len(records) == 2:
+                break
+            time.sleep(0.01)
+        self.assertEqual(records[0]['handshake']['greeting'], 'network/2')
+        self.assertEqual(records[0]['handshake']['options'], {'seq_bits': '32'})
+        rejected = records[1]['handshake']
+        self.assertEqual(rejected['greeting'], 'hello')
+        self.assertFalse(rejected['completed'])
+        self.assertIsNone(rejected['version'])
+        self.assertEqual(rejected['options'], {})
+
+
+def run_server_script(*args):
+    """Run server.py with args in a subprocess, for checks of its command line"""
+    return subprocess.run([sys.executable, 'server.py', *args], cwd=os.path.dirname(os.path.abspath(__file__)),
+                          capture_output=True, timeout=30)
+
+
+class ArgumentTest(unittest.TestCase):
+    def assertUsageError(self, *args):
+        result = run_server_script(*args)
+        self.assertEqual(result.returncode, 2, result.stderr)
+        self.assertNotIn(b'Traceback', result.stderr)
+
+    def test_networks_are_parsed_leniently(self):
+        self.assertEqual(str(cidr('10.0.0.13/24')), '10.0.0.0/24')
+
+    def test_malformed_network_is_a_usage_error(self):
+        with self.assertRaises(argparse.ArgumentTypeError):
+            cidr('10.0.0.0/33')
+        self.assertUsageError('--allow-cidr', '10.0.0.0/33')
+
+    def test_non_positive_limits_are_usage_errors(self):
+        for flag in ('--idle-timeout', '--handshake-timeout', '--session-ttl', '--max-suspended', '--max-batch'):
+            for value in ('0', '-1'):
+                with self.subTest(flag=flag, value=value):
+                    self.assertUsageError(flag, value)
+
+    def test_batch_above_one_read_is_a_usage_error(self):
+        self.assertUsageError('--max-batch', str(MAX_BATCH + 1))
+
+
+class ResumeTest(ServerTestCase):
+    server_options = {'multi_session': True}
+
+    def suspend(self, greeting=b'network/2\n'):
+        """Open a session, deliver one block of it, and drop the connection"""
+        conn, reply = self.connect(greeting)
+        session = dict(option.split('=', 1) for option in reply.split()[1:])['session']
+        conn.sendall(b'1:1101')
+        self.assertEqual(conn.recv(64), b'4\n')
+        conn.close()
+
+        # The session is suspended once the server notices the connection is gone
+        deadline = time.time() + 5
+        while session not in self.server.suspended_sessions and time.time() < deadline:
+            time.sleep(0.01)
+        self.assertIn(session, self.server.suspended_sessions)
+        return session
+
+    def test_resume_reports_position_and_digest(self):
+        session = self.suspend()
+        digest = self.server.suspended_sessions[session][1]['delivered_digest'].hexdigest()
+
+        _, reply = self.connect(f'network/2 session={session}\n'.encode())
+        options = dict(option.split('=', 1) for option in reply.split()[1:])
+        self.assertEqual(options['session'], session)
+        self.assertEqual(options['ack'], '4')
+        self.assertEqual(options['recorded'], '4')
+        self.assertEqual(options['missing'], '1')
+        self.assertEqual(options['digest'], digest)
+        self.assertNotIn(session, self.server.suspended_sessions)
+
+    def test_rejects_unknown_session(self):
+        _, reply = self.connect(b'network/2 session=0123456789ab\n')
+        self.assertTrue(reply.startswith('reject/unknown_session '), reply)
+
+
+class ViolationTest(ServerTestCase):
+    server_options = {'max_violations': 4}
+
+    def test_malformed_frames_disconnect_without_strict(self):
+        conn, _ = self.connect(b'network/2\n')
+        for frame in (b'garbage', b'x:111', b'99999999:11', b'1:1x1'):
+            conn.sendall(frame)
+            # Without --strict every malformed frame is still answered with an ACK
+            self.assertRegex(conn.recv(64), rb'^\d+\n$')
+        self.assertEqual(conn.recv(64), b'')
+        self.server_thread.join(timeout=5)
+        self.assertEqual(self.server.protocol_violations, 4)
+        self.assertEqual(self.server.out_of_range_seqs, 1)
+        self.assertEqual(self.server.termination_reason, 'protocol_violations')
+
+
+class BanTest(ServerTestCase):
+    server_options = {'multi_session': True, 'max_violations': 2, 'ban_duration': 60}
+
+    def test_address_is_banned_after_too_many_violations(self):
+        conn, _ = self.connect(b'network/2\n')
+        for frame in (b'garbage', b'x:111'):
+            conn.sendall(frame)
+            conn.recv(64)
+        self.assertEqual(conn.recv(64), b'')
+        self.assertEqual(self.server.stats()['violations_by_address'], {'127.0.0.1': 2})
+
+        refused = socket.create_connection(('127.0.0.1', self.port), timeout=5)
+        self.addCleanup(refused.close)
+        self.assertEqual(refused.recv(64), b'')
+        self.assertEqual(self.server.banned_connections, 1)
+        self.assertEqual(self.server.stats()['banned_addresses'], 1)
+
+        # Once the ban expires the address may connect again
+        self.server.banned_until['127.0.0.1'] = time.time()
+        _, reply = self.connect(b'network/2\n')
+        self.assertTrue(reply.startswith('success/2 '), reply)
+
+    def test_violations_add_up_across_connections(self):
+        for _ in range(2):
+            conn, _ = self.connect(b'network/2\n')
+            conn.sendall(b'garbage')
+            conn.recv(64)
+            conn.close()
+            # Wait until the server has finished with this connection
+            deadline = time.time() + 5
+            while self.server.termination_reason is None and time.time() < deadline:
+                time.sleep(0.01)
+            self.server.termination_reason = None
+        deadline = time.time() + 5
+        while not self.server.banned_until and time.time() < deadline:
+            time.sleep(0.01)
+        self.assertTrue(self.server.is_banned('127.0.0.1'))
+
+    def test_address_records_are_bounded(self):
+        now = time.time()
+        for i in range(MAX_TRACKED_ADDRESSES + 10):
+            self.server.address_violations[f'10.0.{i // 256}.{i % 256}'] = (1, now)
+        self.server.banned_until['10.1.0.1'] = now - 1
+        self.server.address_violations['10.1.0.2'] = (1, now - 120)
+        self.server.expire_address_records()
+        self.assertEqual(len(self.server.address_violations), MAX_TRACKED_ADDRESSES)
+        # The least recent entries go first
+        self.assertNotIn('10.0.0.0', self.server.address_violations)
+        self.assertNotIn('10.1.0.2', self.server.address_violations)
+        self.assertEqual(self.server.banned_until, {})
+
+    def test_samples_carry_violation_counters(self):
+        conn, _ = self.connect(b'network/2\n')
+        conn.sendall(b'garbage')
+        conn.recv(64)
+        self.server.record_data()
+        sample = self.server.seqs_over_time[-1]
+        self.assertEqual(sample['protocol_violations'], 1)
+        self.assertEqual(sample['session_violations'], 1)
+        self.assertEqual(sample['banned_connections'], 0)
+
+
+class StrictTest(ServerTestCase):
+    server_options = {'strict': True}
+
+    def test_malformed_frames_get_typed_errors(self):
+        conn, _ = self.connect(b'network/2\n')
+        cases = [
+            (b'garbage', b'ERROR:MALFORMED:garbage:0\n'),
+            (b'x:11', b'ERROR:BAD_START:x:0\n'),
+            (b'99999999:11', b'ERROR:SEQ_OUT_OF_RANGE:99999999:0\n'),
+            (b'1:1x1', b'ERROR:BAD_TOKEN:x:3\n'),
+            (b'R\x00\x01\x02', b'ERROR:BAD_LENGTH:3:2\n'),
+        ]
+        for frame, error in cases:
+            with self.subTest(frame=frame):
+                conn.sendall(frame)
+                self.assertEqual(conn.recv(64), error)
+        self.assertEqual(self.server.protocol_violations, len(cases))
+        # A well-formed block is still accepted afterwards
+        conn.sendall(b'1:11')
+        self.assertEqual(conn.recv(64), b'2\n')
+
+
+class ShutdownTest(ServerTestCase):
+    def setUp(self):
+        self.server_options = {'multi_session': True, 'metrics_port': free_port()}
+        super().setUp()
+        # serve() starts the metrics server from its own thread
+        deadline = time.time() + 5
+        while not self.server.metrics_server and time.time() < deadline:
+            time.sleep(0.01)
+
+    def test_serve_stops_every_thread(self):
+        # Keep an SSE stream open so its handler thread has to notice the stop too
+        stream = urllib.request.urlopen(f'http://127.0.0.1:{self.server.metrics_port}/events', timeout=5)
+        self.addCleanup(stream.close)
+        conn, _ = self.connect(b'network/2\n')
+        conn.sendall(b'1:11')
+        conn.recv(64)
+        conn.sendall(b'F{}')
+        conn.recv(1024)
+
+        self.stop_event.set()
+        self.server_thread.join(timeout=5)
+        self.assertFalse(self.server_thread.is_alive())
+        self.assertFalse(self.server.goodput_thread.is_alive())
+        self.assertIn(b'event: end', stream.read())
+        self.assertEqual(wait_for_threads(self.baseline), [])
+
+    def test_stop_ends_session_in_progress(self):
+        conn, _ = self.connect(b'network/2\n')
+        conn.sendall(b'1:11')
+        conn.recv(64)
+
+        # The client stays connected but silent, well within the idle timeout
+        self.stop_event.set()
+        self.server_thread.join(timeout=5)
+        self.assertFalse(self.server_thread.is_alive())
+        self.assertEqual(self.server.termination_reason, 'stopped')
+        self.assertEqual(conn.recv(64), b'')
+        self.assertEqual(wait_for_threads(self.baseline), [])
+
+
+if __name__ == '__main__':
+    unittest.main()
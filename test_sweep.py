@@ -0,0 +1,76 @@
+import os
+import subprocess
+import sys
+import unittest
+
+from sweep import confidence_interval, parse_values, summarize
+
+
+class ParseValuesTest(unittest.TestCase):
+    def test_list(self):
+        self.assertEqual(parse_values('10,100,500', int), [10, 100, 500])
+
+    def test_range_includes_stop(self):
+        self.assertEqual(parse_values('10:50:20', int), [10, 30, 50])
+
+    def test_float_range_tolerates_rounding(self):
+        values = parse_values('0.01:0.05:0.01', float)
+        self.assertEqual(len(values), 5)
+        self.assertAlmostEqual(values[-1], 0.05)
+
+    def test_float_range_has_no_accumulated_error(self):
+        self.assertEqual(parse_values('0.001:0.05:0.01', float), [0.001, 0.011, 0.021, 0.031, 0.041])
+        self.assertEqual(parse_values('0:1:0.1', float)[-1], 1.0)
+
+    def test_invalid_input_raises(self):
+        for text in ('0.1:0.01:0.01', '0.1:0.2:0', '10:100', '1:2:3:4', 'ten,20', '0:inf:1'):
+            with self.subTest(text=text):
+                with self.assertRaises(ValueError):
+                    parse_values(text, float)
+
+
+class SummarizeTest(unittest.TestCase):
+    def test_single_run_has_no_spread(self):
+        self.assertEqual(confidence_interval([0.9]), (0.9, 0.0, 0.0))
+
+    def test_groups_repeats_per_configuration(self):
+        results = [
+            {'drop_prob': 0.01, 'window_size': 100, 'goodput': 0.98, 'duration': 1.0},
+            {'drop_prob': 0.01, 'window_size': 100, 'goodput': 0.99, 'duration': 3.0},
+            {'drop_prob': 0.05, 'window_size': 100, 'goodput': 0.95, 'duration': 2.0},
+        ]
+        first, second = summarize(results)
+        self.assertEqual((first['drop_prob'], first['runs']), (0.01, 2))
+        self.assertAlmostEqual(first['goodput_mean'], 0.985)
+        self.assertAlmostEqual(first['duration_mean'], 2.0)
+        self.assertAlmostEqual(first['duration_stddev'], 2 ** 0.5)
+        # t = 12.706 for one degree of freedom
+        self.assertAlmostEqual(first['duration_ci95'], 12.706 * 2 ** 0.5 / 2 ** 0.5)
+        self.assertEqual((second['drop_prob'], second['runs'], second['goodput_ci95']), (0.05, 1, 0.0))
+
+
+def run_sweep_script(*args):
+    """Run sweep.py with args in a subprocess, for checks of its command line"""
+    return subprocess.run([sys.executable, 'sweep.py', *args], cwd=os.path.dirname(os.path.abspath(__file__)),
+                          capture_output=True, timeout=30)
+
+
+class ArgumentTest(unittest.TestCase):
+    def assertUsageError(self, *args):
+        result = run_sweep_script(*args)
+        self.assertEqual(result.returncode, 2, result.stderr)
+        self.assertNotIn(b'Traceback', result.stderr)
+
+    def test_jobs_must_be_at_least_one(self):
+        for value in ('0', '-1'):
+            with self.subTest(value=value):
+                self.assertUsageError('--jobs', value)
+
+    def test_repeats_must_be_at_least_one(self):
+        for value in ('0', '-1'):
+            with self.subTest(value=value):
+                self.assertUsageError('--repeats', value)
+
+
+if __name__ == '__main__':
+    unittest.main()